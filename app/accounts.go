@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	// Account is an ICQ account dumped in the run; the account without name is the default
+	// one given by --aimsid, its chats and messages are stored without an account tag
+	Account struct {
+		Name, AimSid string
+	}
+
+	// icqAccounts holds API clients of the run accounts by account name
+	icqAccounts map[string]*ICQApi
+
+	// chatRef identifies the chat dump of the account, every account has its own checkpoints
+	chatRef struct {
+		account, chatId string
+	}
+)
+
+func newICQAccounts(params *AppParams, attachmentsDir string, capture apiCapture, replay *apiReplay) icqAccounts {
+	var accounts = make(icqAccounts, len(params.Accounts))
+	for _, v := range params.Accounts {
+		var api = NewICQApi(v.Name, v.AimSid, params.APIUrl, attachmentsDir, params.RateLimit)
+		api.capture, api.replay = capture, replay
+		accounts[v.Name] = api
+	}
+	return accounts
+}
+
+// setupAccounts creates API clients of the run accounts sharing the capture and the replay
+func (m *App) setupAccounts(ctx context.Context, attachmentsDir string) (e error) {
+	if m.params.Capture != "" && m.params.Replay != "" {
+		return errors.New("Replayed responses could not be captured! Give either capture or replay")
+	}
+
+	if m.capture, e = newAPICapture(m.params.Capture); e != nil {
+		return e
+	}
+
+	var replay *apiReplay
+	if replay, e = newAPIReplay(ctx, m.params.Replay); e != nil {
+		return e
+	}
+
+	m.accounts = newICQAccounts(m.params, attachmentsDir, m.capture, replay)
+	return e
+}
+
+func (m *App) closeCapture() {
+	if m.capture == nil {
+		return
+	}
+
+	if e := m.capture.close(); e != nil {
+		gLogger.Error().Err(e).Msg("Could not close API capture")
+	}
+}
+
+func (m icqAccounts) get(name string) (*ICQApi, error) {
+	if api, ok := m[name]; ok {
+		return api, nil
+	}
+
+	return nil, errors.New("Unknown account " + name + " of the job")
+}
+
+// sorted returns API clients ordered by account name, the default account goes first
+func (m icqAccounts) sorted() (apis []*ICQApi) {
+	for _, api := range m {
+		apis = append(apis, api)
+	}
+
+	sort.Slice(apis, func(i, j int) bool { return apis[i].account < apis[j].account })
+	return apis
+}
+
+func (m chatRef) String() string {
+	if m.account == "" {
+		return m.chatId
+	}
+
+	return m.account + "/" + m.chatId
+}
+
+// filter matches the chat record of the account; records of the default account have no account field
+func (m chatRef) filter() bson.M {
+	if m.account == "" {
+		return bson.M{"aimId": m.chatId, "account": bson.M{"$exists": false}}
+	}
+
+	return bson.M{"aimId": m.chatId, "account": m.account}
+}
@@ -1,36 +1,78 @@
 package app
 
 import (
-	"io"
+	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/MindHunter86/icqdumper/system/mongodb"
 	"github.com/rs/zerolog"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	gLogger     *zerolog.Logger
-	gMongoDB    *mongodb.MongoDB
-	gChatsQueue chan *job
-	gDBQueue    chan *job
-	gBuffer     io.Writer
+	gLogger      *zerolog.Logger
+	gMongoDB     *mongodb.MongoDB
+	gChatsQueue  *dispatcher
+	gDBQueue     *dispatcher
+	gProgress    *progress
+	gCheckpoints *checkpoints
+	gJobMetrics  *jobMetrics
+	gWriter      *batchWriter
+	gMetrics     *appMetrics
+	gTracer      trace.Tracer
+	gChatSpans   *chatSpans
+	gRun         *runReport
+	gWindow      *historyWindow
+	gAbort       chan error
 )
 
 type (
 	App struct {
 		params             *AppParams
-		icqClient          *ICQApi
+		fetchCancel        context.CancelFunc
+		storeCancel        context.CancelFunc
+		accounts           icqAccounts
+		capture            apiCapture
 		chatsDispatcher    *dispatcher
 		databaseDispatcher *dispatcher
 		cui                *AppCui
+		cuiLog             *cuiLog
 	}
 	AppParams struct {
 		Silent                               bool
-		AimSid, MongoConn                    string
+		MongoConn                            string
 		Workers, QueueBuffer, WorkerCapacity int
+		UI                                   string
+		ProgressInterval, ShutdownTimeout    time.Duration
+		Restart                              bool
+		AttachmentsDir                       string
+		QueueBackend                         string
+		QueueVisibility, QueueRetryDelay     time.Duration
+		WriteBatch                           int
+		WriteFlushInterval                   time.Duration
+		WriteBacklog                         int64
+		Autoscale                            bool
+		WorkersMin, WorkersMax               int
+		AutoscaleInterval                    time.Duration
+		MetricsListen                        string
+		TraceOTLPEndpoint                    string
+		TraceOTLPInsecure                    bool
+		TraceFile                            string
+		Since, Until                         time.Time
+		Backward                             bool
+		Last                                 int
+		APIUrl                               string
+		RateLimit                            int
+		Accounts                             []*Account
+		Capture, Replay                      string
 	}
 )
 
@@ -42,70 +84,172 @@ func NewApp(l *zerolog.Logger, params *AppParams) *App {
 	}
 }
 
-func (m *App) Bootstrap(chatId string) (e error) {
-
-	gLogger.Debug().Msg("Starting App initialization...")
-
+func (m *App) connectMongoDB() (e error) {
 	gLogger.Debug().Msg("MongoDB bootstrap...")
 	if gMongoDB, e = mongodb.NewMongoDriver(gLogger, m.params.MongoConn); e != nil {
 		return
 	}
 
 	gLogger.Debug().Msg("MongoDB database connect...")
-	if e = gMongoDB.Construct(); e != nil {
+	return gMongoDB.Construct()
+}
+
+// Bootstrap dumps the selected chats; nil selector only resumes jobs of the persistent queue
+func (m *App) Bootstrap(selector *ChatSelector) (e error) {
+
+	gLogger.Debug().Msg("Starting App initialization...")
+
+	// the terminal UI owns the screen, logs are held and shown by the UI until it is closed
+	if m.params.UI == UIModeTUI {
+		m.cuiLog = newCuiLog(os.Stderr)
+		gLogger = m.cuiLog.logger(gLogger)
+		defer m.releaseLog()
+	}
+
+	if e = m.connectMongoDB(); e != nil {
 		return e
 	}
 
+	if e = m.setupAccounts(context.Background(), m.params.AttachmentsDir); e != nil {
+		return e
+	}
+
+	var chatsPrefetch = m.params.Workers * 2
+	if m.params.Autoscale && m.params.WorkersMax > m.params.Workers {
+		chatsPrefetch = m.params.WorkersMax * 2
+	}
+
 	gLogger.Debug().Msg("Queue bootstrap...")
-	m.chatsDispatcher = newDispatcher(m.params.QueueBuffer, m.params.WorkerCapacity)
-	gChatsQueue = m.chatsDispatcher.getQueueChan()
+	switch m.params.QueueBackend {
+	case QueueBackendMongoDB:
+		var owner = uuid.NewV4().String()
+		m.chatsDispatcher = newDurableDispatcher("chats",
+			newMongoJobStore("chats", owner, m.accounts, m.params.QueueVisibility, m.params.QueueRetryDelay),
+			chatsPrefetch, m.params.WorkerCapacity)
+		m.databaseDispatcher = newDurableDispatcher("db",
+			newMongoJobStore("db", owner, m.accounts, m.params.QueueVisibility, m.params.QueueRetryDelay),
+			m.params.Workers*2, m.params.WorkerCapacity)
+	default:
+		m.chatsDispatcher = newDispatcher("chats", m.params.QueueBuffer, m.params.WorkerCapacity).
+			withRetryDelay(m.params.QueueRetryDelay)
+		m.databaseDispatcher = newDispatcher("db", m.params.QueueBuffer, m.params.WorkerCapacity).
+			withRetryDelay(m.params.QueueRetryDelay)
+	}
 
-	m.databaseDispatcher = newDispatcher(m.params.QueueBuffer, m.params.WorkerCapacity)
-	gDBQueue = m.databaseDispatcher.getQueueChan()
+	// pages of one chat are written by one db worker in the fetch order, failed pages are retried in place
+	m.databaseDispatcher.withOrdering(m.params.WriteBatch, m.params.WriteFlushInterval).
+		withRetryDelay(m.params.QueueRetryDelay)
 
-	// bootstrap part
-	var kernSignal = make(chan os.Signal)
-	signal.Notify(kernSignal, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT)
+	if m.params.Autoscale {
+		m.chatsDispatcher.withAutoscaling(
+			newAutoscaler(m.params.WorkersMin, m.params.WorkersMax, m.params.AutoscaleInterval))
+	}
 
-	var waitGroup sync.WaitGroup
-	var errorPipe chan error
+	gChatsQueue = m.chatsDispatcher
+	gDBQueue = m.databaseDispatcher
 
-	go func(ep chan error, wg sync.WaitGroup) {
-		wg.Add(1)
-		defer wg.Done()
+	gProgress = newProgress()
+	gJobMetrics = newJobMetrics()
+	gMetrics = newAppMetrics()
+	gChatSpans = newChatSpans()
 
-		gLogger.Debug().Msg("Starting chats && messages parsing...")
-		var e error
-		m.cui, e = NewAppCui().Bootstrap()
-		ep <- e
-	}(errorPipe, waitGroup)
+	if m.params.TraceOTLPEndpoint != "" || m.params.TraceFile != "" {
+		var tp *sdktrace.TracerProvider
+		if tp, e = newTracerProvider(context.Background(), m.params.TraceOTLPEndpoint, m.params.TraceOTLPInsecure, m.params.TraceFile); e != nil {
+			return e
+		}
+		defer m.shutdownTracing(tp)
+
+		otel.SetTracerProvider(tp)
+	}
+	gTracer = otel.Tracer("icqdumper")
+	gWriter = newBatchWriter(m.params.WriteBacklog)
+	// dumps bounded by since or by messages count are cheaper from the newest message
+	gWindow = &historyWindow{
+		since:    m.params.Since,
+		until:    m.params.Until,
+		backward: m.params.Backward || m.params.Last > 0 || !m.params.Since.IsZero(),
+		last:     m.params.Last,
+	}
+
+	// skipped history must not be hidden from the next full dump by the saved checkpoints
+	gCheckpoints = newCheckpoints(m.params.Restart, gWindow.bounded())
+
+	gRun = newRunReport(m.params, selector)
+	if e = gRun.start(context.Background()); e != nil {
+		return e
+	}
 
-	go func(ep chan error, wg sync.WaitGroup) {
-		wg.Add(1)
+	// fetching is cancelled first on shutdown; db writes are cancelled only when draining is timed out
+	var fetchCtx, storeCtx context.Context
+	fetchCtx, m.fetchCancel = context.WithCancel(context.Background())
+	storeCtx, m.storeCancel = context.WithCancel(context.Background())
+
+	// bootstrap part
+	var kernSignal = make(chan os.Signal, 1)
+	signal.Notify(kernSignal, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	var waitGroup, fetchers sync.WaitGroup
+	var errorPipe = make(chan error, 4)
+	gAbort = make(chan error, 1)
+	var historyPipe = make(chan error, 1)
+	var uiDone = make(chan struct{})
+	var progressDone = make(chan struct{})
+
+	waitGroup.Add(2)
+	go func(ep chan error, wg *sync.WaitGroup) {
 		defer wg.Done()
 
 		gLogger.Debug().Msg("Queue CHAT worker spawn && Queue dispatch...")
-		ep <- m.chatsDispatcher.bootstrap(m.params.Workers)
-	}(errorPipe, waitGroup)
+		ep <- m.chatsDispatcher.bootstrap(fetchCtx, m.params.Workers)
+	}(errorPipe, &waitGroup)
 
-	go func(ep chan error, wg sync.WaitGroup) {
-		wg.Add(1)
+	go func(ep chan error, wg *sync.WaitGroup) {
 		defer wg.Done()
 
 		gLogger.Debug().Msg("Queue DB worker spawn && Queue dispatch...")
-		ep <- m.databaseDispatcher.bootstrap(m.params.Workers)
-	}(errorPipe, waitGroup)
+		ep <- m.databaseDispatcher.bootstrap(storeCtx, m.params.Workers)
+	}(errorPipe, &waitGroup)
 
-	go func(ep chan error, wg sync.WaitGroup) {
-		wg.Add(1)
+	if m.params.MetricsListen != "" {
+		var metricsCtx, metricsCancel = context.WithCancel(context.Background())
+		defer metricsCancel()
+
+		go func(ep chan error) {
+			if e := gMetrics.serve(metricsCtx, m.params.MetricsListen); e != nil {
+				ep <- e
+			}
+		}(errorPipe)
+	}
+
+	fetchers.Add(1)
+	go func(ep chan error, wg *sync.WaitGroup) {
 		defer wg.Done()
 
 		gLogger.Debug().Msg("Starting chats && messages parsing...")
-		ep <- m.CliGetHistory(m.params.AimSid, chatId)
-	}(errorPipe, waitGroup)
+		ep <- m.CliGetHistory(fetchCtx, selector)
+	}(historyPipe, &fetchers)
 
-	log := gLogger.Output(gBuffer).With().Logger()
-	gLogger = &log
+	switch m.params.UI {
+	case UIModeTUI:
+		gLogger.Debug().Msg("Starting terminal UI...")
+		m.cui = NewAppCui()
+
+		go func(ep chan error) {
+			defer close(uiDone)
+			if e := m.cui.Bootstrap(m.getProgress, m.cuiLog); e != nil {
+				ep <- e
+			}
+		}(errorPipe)
+	case UIModePlain:
+		go m.reportProgress(progressDone, m.params.ProgressInterval)
+	}
+
+	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var historyDone bool
+	var runStatus = runStatusInterrupted
 
 LOOP:
 	for {
@@ -113,37 +257,216 @@ LOOP:
 		case <-kernSignal:
 			gLogger.Info().Msg("Syscall.SIG* has been detected! Closing application...")
 			break LOOP
+		case <-uiDone:
+			gLogger.Info().Msg("UI has been closed! Closing application...")
+			break LOOP
 		case e = <-errorPipe:
 			gLogger.Error().Err(e).Msg("Runtime error! Abnormal application closing!")
+			runStatus = runStatusFailed
 			break LOOP
+		case e = <-gAbort:
+			gLogger.Error().Err(e).Msg("Run has been aborted!")
+			runStatus = runStatusFailed
+			break LOOP
+		case e = <-historyPipe:
+			if e != nil {
+				gLogger.Error().Err(e).Msg("Runtime error! Abnormal application closing!")
+				runStatus = runStatusFailed
+				break LOOP
+			}
+
+			historyDone, historyPipe = true, nil
+		case <-ticker.C:
+			// chat jobs enqueue their db jobs before they are done, so check chats first
+			if historyDone && m.chatsDispatcher.getPending() == 0 && m.databaseDispatcher.getPending() == 0 {
+				gLogger.Info().Msg("All chats has been dumped successfully")
+				runStatus = runStatusFinished
+				break LOOP
+			}
 		}
 	}
 
+	if e != nil {
+		gRun.error("", e)
+	}
+
+	m.drain(&fetchers)
+
+	close(progressDone)
+	if m.cui != nil {
+		m.cui.Destroy()
+		<-uiDone
+	}
+	m.releaseLog()
+
+	m.databaseDispatcher.destroy()
+	m.chatsDispatcher.destroy()
 	waitGroup.Wait()
-	return m.Destroy()
+
+	var ctx, cncl = context.WithTimeout(context.Background(), 10*time.Second)
+	if re := gRun.finish(ctx, runStatus, m.getProgress()); re != nil {
+		gLogger.Error().Err(re).Msg("Could not save run report")
+	}
+	cncl()
+
+	if de := m.Destroy(); de != nil && e == nil {
+		e = de
+	}
+
+	return e
+}
+
+// drain stops fetching of new pages and waits for the pending db jobs until shutdown timeout
+func (m *App) drain(fetchers *sync.WaitGroup) {
+	gLogger.Info().Msg("Stopping chats fetching...")
+	m.fetchCancel()
+
+	var ctx, cncl = context.WithTimeout(context.Background(), m.params.ShutdownTimeout)
+	defer cncl()
+
+	var fetchersDone = make(chan struct{})
+	go func() {
+		fetchers.Wait()
+		close(fetchersDone)
+	}()
+
+	select {
+	case <-fetchersDone:
+	case <-ctx.Done():
+	}
+
+	// interrupted chat jobs still could push their last pages to the db queue
+	m.chatsDispatcher.waitIdle(ctx, true)
+
+	gLogger.Info().Int64("pending", m.databaseDispatcher.getPending()).Msg("Draining DB queue...")
+	if !m.databaseDispatcher.waitIdle(ctx, false) {
+		gLogger.Warn().Int64("pending", m.databaseDispatcher.getPending()).
+			Msg("Shutdown timeout has been exceeded! Pending DB jobs will be dropped")
+	}
+
+	m.storeCancel()
 }
 
 func (m *App) Destroy() (e error) {
-	m.databaseDispatcher.destroy()
-	m.chatsDispatcher.destroy()
-	gMongoDB.Destruct()
+	var ctx, cncl = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+
+	gLogger.Debug().Msg("Saving chat checkpoints...")
+	if e = gCheckpoints.persist(ctx); e != nil {
+		gLogger.Error().Err(e).Msg("Could not save chat checkpoints")
+	}
+
+	var snap = m.getProgress()
+	snap.log(gLogger, "Dump summary")
+	if snap.ChatsDone != snap.ChatsQueued {
+		gLogger.Warn().Int64("chats", snap.ChatsQueued-snap.ChatsDone).Msg("Some chats has not been dumped")
+	}
+	gCheckpoints.report()
+	m.closeCapture()
+
+	if de := gMongoDB.Destruct(); de != nil && e == nil {
+		e = de
+	}
+
 	return e
 }
 
-func (m *App) CliGetHistory(aimsid, chatid string) (e error) {
-	m.icqClient = NewICQApi(aimsid)
-	return m.parseChatId(chatid)
+func (m *App) getProgress() *progressSnapshot {
+	return gProgress.snapshot(m.chatsDispatcher, m.databaseDispatcher)
+}
+
+func (m *App) Browse(exportDir string) (e error) {
+
+	if e = m.connectMongoDB(); e != nil {
+		return e
+	}
+	defer gMongoDB.Destruct()
+
+	m.cuiLog = newCuiLog(os.Stderr)
+	gLogger = m.cuiLog.logger(gLogger)
+	defer m.releaseLog()
+
+	return NewAppCui().Browse(exportDir)
+}
+
+// releaseLog prints logs held while the terminal UI has been open
+func (m *App) releaseLog() {
+	if m.cuiLog == nil {
+		return
+	}
+
+	if e := m.cuiLog.release(); e != nil {
+		gLogger.Error().Err(e).Msg("Could not print logs of the terminal UI")
+	}
 }
 
-func (m *App) parseChatId(chatId string) (e error) {
-	switch chatId {
-	case "all":
-		if chats, e := m.icqClient.getChats(); e != nil {
+// CliGetHistory dumps chats selected from buddy lists of every account;
+// chats shared by accounts are stored once, tagged with all of them and fetched by the first account
+func (m *App) CliGetHistory(ctx context.Context, selector *ChatSelector) (e error) {
+	if selector == nil {
+		return nil
+	}
+
+	var apis = m.accounts.sorted()
+	var selected = make([][]*buddyChat, len(apis))
+
+	var chats []*buddyChat
+	for i, api := range apis {
+		var buddies []*buddyChat
+		if selected[i], buddies, e = m.selectChats(ctx, api, selector); e != nil {
+			return e
+		}
+		chats = append(chats, selected[i]...)
+
+		// chats selected by aimId only do not need the buddy list, it is requested for the snapshot then
+		if buddies == nil {
+			if buddies, e = api.getChats(ctx); errors.Is(e, ErrAuthExpired) {
+				return e
+			} else if e != nil {
+				gLogger.Warn().Err(e).Str("account", api.account).Msg("Could not fetch the buddy list, its snapshot is skipped")
+				continue
+			}
+		}
+
+		if e = saveBuddySnapshot(ctx, api.account, buddies); e != nil {
 			return e
-		} else {
-			return m.icqClient.getChatsMessages(chats)
 		}
-	default:
-		return m.icqClient.getChatMessages(chatId, 1)
 	}
+
+	if e = saveChats(ctx, chats); e != nil {
+		return e
+	}
+
+	var fetched = fetchedChatIds(selected)
+	for i, api := range apis {
+		var chatIds = fetched[i]
+
+		if e = api.dumpChatsInfo(ctx, chatIds); e != nil {
+			return e
+		}
+
+		if e = api.getChatsMessages(ctx, chatIds); e != nil {
+			return e
+		}
+	}
+
+	return e
+}
+
+// fetchedChatIds returns aimIds fetched by every account, chats selected by several accounts
+// are fetched only by the first of them
+func fetchedChatIds(selected [][]*buddyChat) (chatIds [][]string) {
+	var fetched = make(map[string]bool)
+
+	chatIds = make([][]string, len(selected))
+	for i, chats := range selected {
+		for _, v := range chats {
+			if !fetched[v.AimId] {
+				fetched[v.AimId] = true
+				chatIds[i] = append(chatIds[i], v.AimId)
+			}
+		}
+	}
+
+	return chatIds
 }
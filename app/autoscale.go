@@ -0,0 +1,107 @@
+package app
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	autoscaleErrorRate   = 0.1
+	autoscaleMinRuns     = 10
+	autoscaleLatencyRate = 2
+)
+
+type (
+	// autoscaler grows the worker pool while jobs are waiting for workers and
+	// shrinks it when workers are idle or when jobs begin to fail (e.g. API rate limiting)
+	autoscaler struct {
+		dp       *dispatcher
+		min, max int64
+		interval time.Duration
+
+		baseLatency time.Duration
+	}
+)
+
+func newAutoscaler(min, max int, interval time.Duration) *autoscaler {
+	return &autoscaler{
+		min:      int64(min),
+		max:      int64(max),
+		interval: interval,
+	}
+}
+
+func (m *autoscaler) run(wg *sync.WaitGroup) {
+	var ticker = time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.dp.done:
+			return
+		case <-ticker.C:
+			m.scale(wg)
+		}
+	}
+}
+
+func (m *autoscaler) scale(wg *sync.WaitGroup) {
+	var runs = atomic.SwapInt64(&m.dp.runs, 0)
+	var fails = atomic.SwapInt64(&m.dp.fails, 0)
+	var busy = time.Duration(atomic.SwapInt64(&m.dp.busy, 0))
+
+	var size = m.dp.getWorkers() - atomic.LoadInt64(&m.dp.retire)
+	var idle = int64(len(m.dp.pool))
+	var backlog = m.dp.getPending() - size
+
+	var latency time.Duration
+	if runs != 0 {
+		latency = busy / time.Duration(runs)
+		if m.baseLatency == 0 || latency < m.baseLatency {
+			m.baseLatency = latency
+		}
+	}
+
+	var target = size
+	var reason string
+
+	switch {
+	case runs >= autoscaleMinRuns && float64(fails)/float64(runs) > autoscaleErrorRate:
+		target, reason = size/2, "error rate is high"
+	case backlog > 0 && idle == 0 && latency > m.baseLatency*autoscaleLatencyRate:
+		reason = "latency is growing"
+	case backlog > 0 && idle == 0:
+		target, reason = size+size/4+1, "jobs are waiting for workers"
+	case backlog <= 0 && idle > size/2:
+		target, reason = size-size/4, "workers are idle"
+	}
+
+	if target < m.min {
+		target = m.min
+	}
+	if target > m.max {
+		target = m.max
+	}
+
+	if target == size {
+		return
+	}
+
+	gLogger.Info().Str("queue", m.dp.name).Int64("from", size).Int64("to", target).Str("reason", reason).
+		Int64("runs", runs).Int64("fails", fails).Dur("latency", latency).Int64("backlog", backlog).
+		Msg("Worker pool has been resized")
+
+	if target < size {
+		m.dp.retireWorkers(size - target)
+		return
+	}
+
+	for i := size; i < target; i++ {
+		// retire requests that have not been taken by workers yet are cancelled first
+		if m.dp.retired() {
+			continue
+		}
+		m.dp.spawnWorker(wg)
+	}
+}
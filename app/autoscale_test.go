@@ -0,0 +1,42 @@
+package app
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idle workers wait for jobs and never check retire requests themselves, so they are retired through the pool
+func TestRetireWorkersStopsIdleWorkers(t *testing.T) {
+	var dp = newDispatcher("chats", 1, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		dp.spawnWorker(&wg)
+	}
+
+	var deadline = time.Now().Add(time.Second)
+	for len(dp.pool) != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d idle workers, want 4", len(dp.pool))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	dp.retireWorkers(3)
+
+	for dp.getWorkers() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d workers after retiring idle ones, want 1", dp.getWorkers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if retire := atomic.LoadInt64(&dp.retire); retire != 0 {
+		t.Errorf("got %d retire requests left for busy workers, want 0", retire)
+	}
+
+	close(dp.workerDone)
+	wg.Wait()
+}
@@ -0,0 +1,414 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"github.com/jroimartin/gocui"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	browsePromptNone = uint8(iota)
+	browsePromptSearch
+	browsePromptDate
+)
+
+const (
+	browseViewChats      = "chats"
+	browseViewTranscript = "transcript"
+	browseViewStatus     = "status"
+	browseViewPrompt     = "prompt"
+)
+
+const browseStatusHelp = "j/k move  tab switch  enter open  / search  n/N next/prev  t jump to date  e export  q quit"
+
+type browseKeybinding struct {
+	view    string
+	key     interface{}
+	handler func(*gocui.Gui, *gocui.View) error
+}
+
+func (m *AppCui) Browse(exportDir string) (e error) {
+	m.exportDir = exportDir
+	m.status = browseStatusHelp
+
+	if e = m.loadChats(); e != nil {
+		return e
+	}
+
+	if m.cui, e = gocui.NewGui(gocui.OutputNormal); e != nil {
+		return e
+	}
+	defer m.cui.Close()
+
+	m.cui.InputEsc = true
+	m.cui.Highlight = true
+	m.cui.SelFgColor = gocui.ColorGreen
+	m.cui.SetManagerFunc(m.browseLayout)
+
+	if e = m.browseKeybindings(); e != nil {
+		return e
+	}
+
+	if e = m.cui.MainLoop(); e != nil && e != gocui.ErrQuit {
+		return e
+	}
+
+	return nil
+}
+
+func (m *AppCui) browseKeybindings() (e error) {
+	var bindings = []*browseKeybinding{
+		{"", gocui.KeyCtrlC, m.quit},
+
+		{browseViewChats, 'q', m.quit},
+		{browseViewChats, 'j', m.chatsMove(1)},
+		{browseViewChats, gocui.KeyArrowDown, m.chatsMove(1)},
+		{browseViewChats, 'k', m.chatsMove(-1)},
+		{browseViewChats, gocui.KeyArrowUp, m.chatsMove(-1)},
+		{browseViewChats, 'g', m.chatsMove(-len(m.chats))},
+		{browseViewChats, 'G', m.chatsMove(len(m.chats))},
+		{browseViewChats, gocui.KeyEnter, m.openChat},
+		{browseViewChats, 'l', m.focus(browseViewTranscript)},
+		{browseViewChats, gocui.KeyTab, m.focus(browseViewTranscript)},
+
+		{browseViewTranscript, 'q', m.quit},
+		{browseViewTranscript, 'j', m.transcriptMove(1)},
+		{browseViewTranscript, gocui.KeyArrowDown, m.transcriptMove(1)},
+		{browseViewTranscript, 'k', m.transcriptMove(-1)},
+		{browseViewTranscript, gocui.KeyArrowUp, m.transcriptMove(-1)},
+		{browseViewTranscript, gocui.KeyCtrlD, m.transcriptPage(1)},
+		{browseViewTranscript, gocui.KeyPgdn, m.transcriptPage(1)},
+		{browseViewTranscript, gocui.KeyCtrlU, m.transcriptPage(-1)},
+		{browseViewTranscript, gocui.KeyPgup, m.transcriptPage(-1)},
+		{browseViewTranscript, 'g', m.transcriptEdge(false)},
+		{browseViewTranscript, 'G', m.transcriptEdge(true)},
+		{browseViewTranscript, 'h', m.focus(browseViewChats)},
+		{browseViewTranscript, gocui.KeyTab, m.focus(browseViewChats)},
+		{browseViewTranscript, '/', m.openPrompt(browsePromptSearch)},
+		{browseViewTranscript, 'n', m.searchNext(true)},
+		{browseViewTranscript, 'N', m.searchNext(false)},
+		{browseViewTranscript, 't', m.openPrompt(browsePromptDate)},
+		{browseViewTranscript, 'e', m.exportCurrentChat},
+
+		{browseViewPrompt, gocui.KeyEnter, m.commitPrompt},
+		{browseViewPrompt, gocui.KeyEsc, m.closePrompt},
+	}
+
+	for _, v := range bindings {
+		if e = m.cui.SetKeybinding(v.view, v.key, gocui.ModNone, v.handler); e != nil {
+			return e
+		}
+	}
+
+	return e
+}
+
+func (m *AppCui) browseLayout(g *gocui.Gui) (e error) {
+	maxX, maxY := g.Size()
+
+	var split = maxX / 4
+	if split < 20 {
+		split = 20
+	}
+
+	var v *gocui.View
+	if v, e = g.SetView(browseViewChats, 0, 0, split-1, maxY-2); e != nil {
+		if e != gocui.ErrUnknownView {
+			return e
+		}
+
+		v.Title = "Chats"
+		v.Highlight = true
+		v.SelBgColor = gocui.ColorBlue
+		for _, chat := range m.chats {
+			fmt.Fprintf(v, "%s (%s)\n", chat.Name, chat.AimId)
+		}
+
+		if _, e = g.SetCurrentView(browseViewChats); e != nil {
+			return e
+		}
+	}
+
+	if v, e = g.SetView(browseViewTranscript, split, 0, maxX-1, maxY-2); e != nil {
+		if e != gocui.ErrUnknownView {
+			return e
+		}
+
+		v.Title = "Transcript"
+		v.Highlight = true
+		v.SelBgColor = gocui.ColorBlue
+	}
+
+	if v, e = g.SetView(browseViewStatus, -1, maxY-2, maxX, maxY); e != nil && e != gocui.ErrUnknownView {
+		return e
+	}
+	v.Frame = false
+	v.Clear()
+	fmt.Fprint(v, m.status)
+
+	if m.prompt == browsePromptNone {
+		return nil
+	}
+
+	if v, e = g.SetView(browseViewPrompt, split, maxY-5, maxX-1, maxY-3); e != nil {
+		if e != gocui.ErrUnknownView {
+			return e
+		}
+
+		switch m.prompt {
+		case browsePromptSearch:
+			v.Title = "Search"
+		case browsePromptDate:
+			v.Title = "Jump to date (YYYY-MM-DD [HH:MM])"
+		}
+		v.Editable = true
+
+		if _, e = g.SetCurrentView(browseViewPrompt); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (m *AppCui) loadChats() (e error) {
+	return gMongoDB.Find(context.Background(), "chats", bson.M{}, &m.chats,
+		options.Find().SetProjection(bson.M{"messages": 0}).SetSort(bson.M{"name": 1}))
+}
+
+func (m *AppCui) loadChat(aimId string) (e error) {
+	var chat = new(mongodb.CollectionChats)
+	if e = gMongoDB.FindOne(context.Background(), "chats", bson.M{"aimId": aimId}, chat); e != nil {
+		return e
+	}
+
+	m.chat, m.lines, m.msgLines = chat, nil, nil
+	for i := range chat.Messages {
+		m.msgLines = append(m.msgLines, len(m.lines))
+		m.lines = append(m.lines, formatMessageLines(&chat.Messages[i])...)
+	}
+
+	return e
+}
+
+func (m *AppCui) openChat(g *gocui.Gui, v *gocui.View) (e error) {
+	if len(m.chats) == 0 {
+		return nil
+	}
+
+	var chat = m.chats[currentLine(v)]
+	if e = m.loadChat(chat.AimId); e != nil {
+		m.status = "Could not load chat " + chat.AimId + ": " + e.Error()
+		return nil
+	}
+
+	var tv *gocui.View
+	if tv, e = g.View(browseViewTranscript); e != nil {
+		return e
+	}
+
+	tv.Clear()
+	tv.Title = fmt.Sprintf("%s (%d messages)", chat.Name, len(m.chat.Messages))
+	for _, line := range m.lines {
+		fmt.Fprintln(tv, line)
+	}
+
+	m.status = browseStatusHelp
+	if e = setLine(tv, 0, len(m.lines)); e != nil {
+		return e
+	}
+
+	_, e = g.SetCurrentView(browseViewTranscript)
+	return e
+}
+
+func (m *AppCui) focus(view string) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) (e error) {
+		_, e = g.SetCurrentView(view)
+		return e
+	}
+}
+
+func (m *AppCui) chatsMove(delta int) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		return setLine(v, currentLine(v)+delta, len(m.chats))
+	}
+}
+
+func (m *AppCui) transcriptMove(delta int) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		return setLine(v, currentLine(v)+delta, len(m.lines))
+	}
+}
+
+func (m *AppCui) transcriptPage(direction int) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		_, maxY := v.Size()
+		return setLine(v, currentLine(v)+direction*maxY/2, len(m.lines))
+	}
+}
+
+func (m *AppCui) transcriptEdge(bottom bool) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if bottom {
+			return setLine(v, len(m.lines)-1, len(m.lines))
+		}
+		return setLine(v, 0, len(m.lines))
+	}
+}
+
+func (m *AppCui) openPrompt(prompt uint8) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if m.chat == nil {
+			m.status = "Open a chat first"
+			return nil
+		}
+
+		m.prompt = prompt
+		return nil
+	}
+}
+
+func (m *AppCui) closePrompt(g *gocui.Gui, v *gocui.View) (e error) {
+	m.prompt = browsePromptNone
+	if e = g.DeleteView(browseViewPrompt); e != nil {
+		return e
+	}
+
+	_, e = g.SetCurrentView(browseViewTranscript)
+	return e
+}
+
+func (m *AppCui) commitPrompt(g *gocui.Gui, v *gocui.View) (e error) {
+	var input = strings.TrimSpace(v.Buffer())
+	var prompt = m.prompt
+
+	if e = m.closePrompt(g, v); e != nil {
+		return e
+	}
+
+	var tv *gocui.View
+	if tv, e = g.View(browseViewTranscript); e != nil {
+		return e
+	}
+
+	switch prompt {
+	case browsePromptSearch:
+		m.search = input
+		return m.searchNext(true)(g, tv)
+	case browsePromptDate:
+		return m.jumpToDate(tv, input)
+	}
+
+	return nil
+}
+
+func (m *AppCui) searchNext(forward bool) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if m.search == "" || len(m.lines) == 0 {
+			return nil
+		}
+
+		var needle = strings.ToLower(m.search)
+		var step = 1
+		if !forward {
+			step = -1
+		}
+
+		var current = currentLine(v)
+		for i := 1; i <= len(m.lines); i++ {
+			var line = ((current+i*step)%len(m.lines) + len(m.lines)) % len(m.lines)
+			if strings.Contains(strings.ToLower(m.lines[line]), needle) {
+				m.status = fmt.Sprintf("/%s: line %d of %d", m.search, line+1, len(m.lines))
+				return setLine(v, line, len(m.lines))
+			}
+		}
+
+		m.status = "Pattern not found: " + m.search
+		return nil
+	}
+}
+
+func (m *AppCui) jumpToDate(v *gocui.View, input string) (e error) {
+	var date time.Time
+	if date, e = parseBrowseDate(input); e != nil {
+		m.status = e.Error()
+		return nil
+	}
+
+	for i := range m.chat.Messages {
+		if !m.chat.Messages[i].Time.Before(date) {
+			m.status = "Jumped to " + m.chat.Messages[i].Time.Local().Format("2006-01-02 15:04:05")
+			return setLine(v, m.msgLines[i], len(m.lines))
+		}
+	}
+
+	m.status = "No messages after " + input
+	return nil
+}
+
+func (m *AppCui) exportCurrentChat(g *gocui.Gui, v *gocui.View) (e error) {
+	if m.chat == nil {
+		m.status = "Open a chat first"
+		return nil
+	}
+
+	var path string
+	if path, e = exportChatToFile(m.exportDir, m.chat); e != nil {
+		m.status = "Could not export chat: " + e.Error()
+		return nil
+	}
+
+	m.status = "Chat has been exported to " + path
+	return nil
+}
+
+func parseBrowseDate(input string) (date time.Time, e error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if date, e = time.ParseInLocation(layout, input, time.Local); e == nil {
+			return date, e
+		}
+	}
+
+	return date, errors.New("Could not parse date " + input)
+}
+
+func currentLine(v *gocui.View) int {
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	return cy + oy
+}
+
+func setLine(v *gocui.View, line, total int) (e error) {
+	if line >= total {
+		line = total - 1
+	}
+	if line < 0 {
+		line = 0
+	}
+
+	_, maxY := v.Size()
+	if maxY <= 0 {
+		return nil
+	}
+
+	_, oy := v.Origin()
+	if line < oy {
+		oy = line
+	} else if line >= oy+maxY {
+		oy = line - maxY + 1
+	}
+
+	if e = v.SetOrigin(0, oy); e != nil {
+		return e
+	}
+
+	return v.SetCursor(0, line-oy)
+}
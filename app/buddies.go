@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// kinds of buddy list changes of buddy_snapshots
+const (
+	buddyAdded   = "added"
+	buddyRemoved = "removed"
+	buddyRenamed = "renamed"
+	buddyMoved   = "moved"
+)
+
+func newBuddySnapshot(account string, buddies []*buddyChat) *mongodb.CollectionBuddySnapshots {
+	var snapshot = &mongodb.CollectionBuddySnapshots{
+		Account:  account,
+		TakenAt:  time.Now(),
+		Contacts: make([]mongodb.CollectionBuddySnapshotsContact, 0, len(buddies)),
+	}
+
+	for _, v := range buddies {
+		snapshot.Contacts = append(snapshot.Contacts, mongodb.CollectionBuddySnapshotsContact{
+			AimId:    v.AimId,
+			Name:     v.Name,
+			Groups:   v.Groups,
+			UserType: v.UserType,
+		})
+	}
+
+	return snapshot
+}
+
+// buddyChanges compares buddy lists by aimId; a contact is moved if the set of its groups has changed
+func buddyChanges(previous, snapshot *mongodb.CollectionBuddySnapshots) (changes []mongodb.CollectionBuddySnapshotsChange) {
+	var contacts = make(map[string]*mongodb.CollectionBuddySnapshotsContact, len(previous.Contacts))
+	for i, v := range previous.Contacts {
+		if _, ok := contacts[v.AimId]; !ok {
+			contacts[v.AimId] = &previous.Contacts[i]
+		}
+	}
+
+	var seen = make(map[string]bool, len(snapshot.Contacts))
+	for _, v := range snapshot.Contacts {
+		if seen[v.AimId] {
+			continue
+		}
+		seen[v.AimId] = true
+
+		var prev, ok = contacts[v.AimId]
+		if !ok {
+			changes = append(changes, mongodb.CollectionBuddySnapshotsChange{
+				AimId: v.AimId, Change: buddyAdded, Name: v.Name, Groups: v.Groups,
+			})
+			continue
+		}
+
+		if prev.Name != v.Name {
+			changes = append(changes, mongodb.CollectionBuddySnapshotsChange{
+				AimId: v.AimId, Change: buddyRenamed, Name: v.Name, PreviousName: prev.Name,
+			})
+		}
+		if !sameGroups(prev.Groups, v.Groups) {
+			changes = append(changes, mongodb.CollectionBuddySnapshotsChange{
+				AimId: v.AimId, Change: buddyMoved, Groups: v.Groups, PreviousGroups: prev.Groups,
+			})
+		}
+	}
+
+	for _, v := range previous.Contacts {
+		if !seen[v.AimId] {
+			seen[v.AimId] = true
+			changes = append(changes, mongodb.CollectionBuddySnapshotsChange{
+				AimId: v.AimId, Change: buddyRemoved, PreviousName: v.Name, PreviousGroups: v.Groups,
+			})
+		}
+	}
+
+	return changes
+}
+
+func sameGroups(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	var groups = make(map[string]bool, len(a))
+	for _, v := range a {
+		groups[v] = true
+	}
+	for _, v := range b {
+		if !groups[v] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// saveBuddySnapshot stores the buddy list of the account with changes since its previous snapshot;
+// the first snapshot of the account has no changes
+func saveBuddySnapshot(ctx context.Context, account string, buddies []*buddyChat) (e error) {
+	var snapshot = newBuddySnapshot(account, buddies)
+
+	var previous = new(mongodb.CollectionBuddySnapshots)
+	e = gMongoDB.FindOne(ctx, "buddy_snapshots", bson.M{"account": account}, previous,
+		options.FindOne().SetSort(bson.M{"takenAt": -1}))
+	if e != nil && e != mongo.ErrNoDocuments {
+		return e
+	}
+
+	if e == nil {
+		snapshot.Changes = buddyChanges(previous, snapshot)
+	}
+
+	var data interface{} = snapshot
+	if e = gMongoDB.InsertOne(ctx, "buddy_snapshots", &data); e != nil {
+		return e
+	}
+
+	gLogger.Info().Str("account", account).Int("contacts", len(snapshot.Contacts)).Int("changes", len(snapshot.Changes)).
+		Msg("Buddy list snapshot has been successfully saved")
+	return nil
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuddyChanges(t *testing.T) {
+	var previous = []*buddyChat{
+		{AimId: "100@chat.agent", Name: "Team", Groups: []string{"Work"}},
+		{AimId: "200@chat.agent", Name: "Family", Groups: []string{"Home", "General"}},
+		{AimId: "300@chat.agent", Name: "Old", Groups: []string{"General"}},
+	}
+
+	var tests = []struct {
+		name    string
+		buddies []*buddyChat
+		changes []string
+	}{
+		{"unchanged", previous, nil},
+		{"groups reordered", []*buddyChat{
+			previous[0],
+			{AimId: "200@chat.agent", Name: "Family", Groups: []string{"General", "Home"}},
+			previous[2],
+		}, nil},
+		{"added and removed", []*buddyChat{
+			previous[0], previous[1], {AimId: "400@chat.agent", Name: "New", Groups: []string{"Work"}},
+		}, []string{"400@chat.agent added", "300@chat.agent removed"}},
+		{"renamed and moved", []*buddyChat{
+			{AimId: "100@chat.agent", Name: "Team 2", Groups: []string{"Archive"}}, previous[1], previous[2],
+		}, []string{"100@chat.agent renamed", "100@chat.agent moved"}},
+		{"duplicated contact", []*buddyChat{
+			previous[0], previous[0], previous[1], previous[2],
+		}, nil},
+		{"empty list", nil, []string{"100@chat.agent removed", "200@chat.agent removed", "300@chat.agent removed"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []string
+			for _, v := range buddyChanges(newBuddySnapshot("work", previous), newBuddySnapshot("work", tt.buddies)) {
+				changes = append(changes, v.AimId+" "+v.Change)
+			}
+
+			if !reflect.DeepEqual(changes, tt.changes) {
+				t.Errorf("got changes %v, want %v", changes, tt.changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CaptureMongoDB stores raw API requests in the rapi_requests collection instead of a file
+const CaptureMongoDB = "mongodb"
+
+type (
+	// apiCapture stores raw API requests with their responses
+	apiCapture interface {
+		write(ctx context.Context, record *mongodb.CollectionRAPIRequests) error
+		close() error
+	}
+	mongoCapture struct{}
+	// fileCapture writes records as gzipped JSON lines
+	fileCapture struct {
+		sync.Mutex
+		fd  *os.File
+		zw  *gzip.Writer
+		enc *json.Encoder
+	}
+
+	// apiReplay serves captured responses instead of the network; responses of the same request
+	// are served in the capture order, the last one is repeated
+	apiReplay struct {
+		sync.Mutex
+		records map[string][]*mongodb.CollectionRAPIRequests
+	}
+)
+
+func newAPICapture(target string) (apiCapture, error) {
+	switch target {
+	case "":
+		return nil, nil
+	case CaptureMongoDB:
+		if gMongoDB == nil {
+			return nil, errors.New("Capture to MongoDB requires the MongoDB connection!")
+		}
+		return new(mongoCapture), nil
+	}
+
+	var fd, e = os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if e != nil {
+		return nil, e
+	}
+
+	var zw = gzip.NewWriter(fd)
+	return &fileCapture{
+		fd:  fd,
+		zw:  zw,
+		enc: json.NewEncoder(zw),
+	}, nil
+}
+
+func (m *mongoCapture) write(ctx context.Context, record *mongodb.CollectionRAPIRequests) error {
+	var data interface{} = record
+	return gMongoDB.InsertOne(ctx, "rapi_requests", &data)
+}
+
+func (m *mongoCapture) close() error { return nil }
+
+func (m *fileCapture) write(_ context.Context, record *mongodb.CollectionRAPIRequests) error {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.enc.Encode(record)
+}
+
+func (m *fileCapture) close() (e error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if e = m.zw.Close(); e != nil {
+		m.fd.Close()
+		return e
+	}
+
+	return m.fd.Close()
+}
+
+// captureResponse completes the record with the response and stores it; the response body is
+// read out and replaced, so the caller decodes it as usual
+func captureResponse(ctx context.Context, capture apiCapture, record *mongodb.CollectionRAPIRequests,
+	started time.Time, rsp *http.Response, rspErr error) (*http.Response, error) {
+
+	record.StartedAt, record.Duration = started, time.Since(started)
+
+	if rspErr != nil {
+		record.Error = rspErr.Error()
+	} else {
+		var body, e = io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		rsp.Body = io.NopCloser(bytes.NewReader(body))
+
+		record.Status, record.Body = rsp.StatusCode, string(body)
+		if e != nil {
+			record.Error, rspErr = e.Error(), e
+		}
+	}
+
+	if e := capture.write(ctx, record); e != nil {
+		gLogger.Warn().Err(e).Str("method", record.Method).Str("reqId", record.ReqId).Msg("Could not capture API request")
+	}
+
+	return rsp, rspErr
+}
+
+func replayKey(record *mongodb.CollectionRAPIRequests) string {
+	if record.Params == nil {
+		return fmt.Sprintf("%s|%s", record.Account, record.Method)
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%d|%d|%s", record.Account, record.Method,
+		record.Params.Sn, record.Params.FromMsgId, record.Params.Count, record.Params.Cursor)
+}
+
+// newAPIReplay loads the capture file or the rapi_requests collection
+func newAPIReplay(ctx context.Context, source string) (replay *apiReplay, e error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	var records []*mongodb.CollectionRAPIRequests
+	if records, e = loadCapture(ctx, source); e != nil {
+		return nil, e
+	}
+
+	replay = &apiReplay{
+		records: make(map[string][]*mongodb.CollectionRAPIRequests),
+	}
+	for _, v := range records {
+		replay.records[replayKey(v)] = append(replay.records[replayKey(v)], v)
+	}
+
+	gLogger.Info().Str("source", source).Int("records", len(records)).Msg("API capture has been successfully loaded for replay")
+	return replay, e
+}
+
+// loadCapture reads captured records of the rapi_requests collection or of the capture file in the capture order
+func loadCapture(ctx context.Context, source string) (records []*mongodb.CollectionRAPIRequests, e error) {
+	if source != CaptureMongoDB {
+		return readCaptureFile(source)
+	}
+
+	if gMongoDB == nil {
+		return nil, errors.New("Capture in MongoDB requires the MongoDB connection!")
+	}
+
+	e = gMongoDB.Find(ctx, "rapi_requests", bson.M{}, &records, options.Find().SetSort(bson.M{"startedAt": 1}))
+	return records, e
+}
+
+// readCaptureFile reads all gzip members appended to the file by capture runs
+func readCaptureFile(path string) (records []*mongodb.CollectionRAPIRequests, e error) {
+	var fd *os.File
+	if fd, e = os.Open(path); e != nil {
+		return nil, e
+	}
+	defer fd.Close()
+
+	var zr *gzip.Reader
+	if zr, e = gzip.NewReader(fd); e != nil {
+		return nil, e
+	}
+	defer zr.Close()
+
+	var dec = json.NewDecoder(zr)
+	for {
+		var record = new(mongodb.CollectionRAPIRequests)
+		if e = dec.Decode(record); e == io.EOF {
+			return records, nil
+		} else if e != nil {
+			return nil, errors.New("Could not read capture file " + path + "! " + e.Error())
+		}
+
+		records = append(records, record)
+	}
+}
+
+func (m *apiReplay) response(req *http.Request, record *mongodb.CollectionRAPIRequests) (*http.Response, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var key = replayKey(record)
+	var captured = m.records[key]
+	if len(captured) == 0 {
+		return nil, errors.New("no captured response for " + strings.ReplaceAll(key, "|", " "))
+	}
+
+	var v = captured[0]
+	if len(captured) > 1 {
+		m.records[key] = captured[1:]
+	}
+
+	if v.Error != "" && v.Status == 0 {
+		return nil, errors.New(v.Error)
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", v.Status, http.StatusText(v.Status)),
+		StatusCode: v.Status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(v.Body)),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,313 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	uuid "github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const chatInviteUrl = "https://icq.im/"
+
+type (
+	// POST /rapi (getChatInfo)
+	getChatInfoReq struct {
+		Method string                `json:"method,omitempty"`
+		ReqId  string                `json:"reqId,omitempty"`
+		Aimsid string                `json:"aimsid,omitempty"`
+		Params *getChatInfoReqParams `json:"params,omitempty"`
+	}
+	getChatInfoReqParams struct {
+		Sn string `json:"sn,omitempty"`
+	}
+
+	getChatInfoRsp struct {
+		Timestamp uint64                `json:"ts,omitempty"`
+		Status    *getHistoryRspStatus  `json:"status,omitempty"`
+		Method    string                `json:"method,omitempty"`
+		ReqId     string                `json:"reqId,omitempty"`
+		Results   *getChatInfoRspResult `json:"results,omitempty"`
+	}
+	getChatInfoRspResult struct {
+		Sn           string `json:"sn,omitempty"`
+		Name         string `json:"name,omitempty"`
+		About        string `json:"about,omitempty"`
+		Rules        string `json:"rules,omitempty"`
+		Creator      string `json:"creator,omitempty"`
+		MembersCount int    `json:"membersCount,omitempty"`
+		Public       bool   `json:"public,omitempty"`
+		Stamp        string `json:"stamp,omitempty"`
+	}
+)
+
+// isGroupChat reports whether the buddy list chat has the chat info, personal chats have not
+func isGroupChat(aimId string) bool {
+	return strings.HasSuffix(aimId, "@chat.agent")
+}
+
+func (m *ICQApi) getChatInfo(ctx context.Context, chatId string) (info *getChatInfoRspResult, e error) {
+	gLogger.Debug().Str("chatId", chatId).Msg("Trying to fetch chat info")
+
+	var reqId = uuid.NewV4()
+
+	var reqUrl *url.URL
+	if reqUrl, e = url.Parse(m.apiUrl + "/rapi"); e != nil {
+		return nil, e
+	}
+
+	var buf = new(bytes.Buffer)
+	if e = json.NewEncoder(buf).Encode(&getChatInfoReq{
+		"getChatInfo", reqId.String(), m.aimsid, &getChatInfoReqParams{chatId},
+	}); e != nil {
+		return nil, e
+	}
+
+	var req *http.Request
+	if req, e = http.NewRequestWithContext(ctx, "POST", reqUrl.String(), buf); e != nil {
+		return nil, e
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Ubuntu Chromium/62.0.3202.89 Chrome/62.0.3202.89 Safari/537.36")
+	req.Header.Set("Origin", m.apiUrl+"/rapi")
+	req.Header.Add("X-Requested-With", "XMLHttpRequest")
+
+	var rsp *http.Response
+	if rsp, e = m.do(req, &mongodb.CollectionRAPIRequests{
+		Method: "getChatInfo", ReqId: reqId.String(), Account: m.account,
+		Params: &mongodb.CollectionRAPIRequestsParams{Sn: chatId},
+	}); e != nil {
+		return nil, e
+	}
+	defer rsp.Body.Close()
+
+	if e = newAPIError("getChatInfo", m.account, rsp.StatusCode, rsp.Status); e != nil {
+		return nil, e
+	}
+
+	var infoResponse *getChatInfoRsp
+	if infoResponse, e = m.getChatInfoResponse(&rsp.Body); e != nil {
+		return nil, e
+	}
+
+	return infoResponse.Results, e
+}
+
+func (m *ICQApi) getChatInfoResponse(r *io.ReadCloser) (infoResponse *getChatInfoRsp, e error) {
+	var data []byte
+	if data, e = ioutil.ReadAll(*r); e != nil {
+		return nil, e
+	}
+
+	if e = json.Unmarshal(data, &infoResponse); e != nil {
+		return nil, e
+	}
+
+	if infoResponse != nil && infoResponse.Status != nil {
+		if e = newAPIError("getChatInfo", m.account, infoResponse.Status.Code, infoResponse.Status.Reason); e != nil {
+			return nil, e
+		}
+	}
+
+	return infoResponse, infoResponse.validate()
+}
+
+// avatarUrl is the link of the largest avatar image of the chat
+func (m *ICQApi) avatarUrl(chatId string) string {
+	return m.apiUrl + "/expressions/get?f=native&type=largeBuddyIcon&t=" + url.QueryEscape(chatId)
+}
+
+// newChatInfo leaves admins empty, they are taken from the full member list
+func (m *ICQApi) newChatInfo(result *getChatInfoRspResult) *mongodb.CollectionChatsInfo {
+	var info = &mongodb.CollectionChatsInfo{
+		Name:         result.Name,
+		About:        result.About,
+		Rules:        result.Rules,
+		Creator:      result.Creator,
+		MembersCount: result.MembersCount,
+		Public:       result.Public,
+		AvatarUrl:    m.avatarUrl(result.Sn),
+		UpdatedAt:    time.Now(),
+	}
+
+	if result.Stamp != "" {
+		info.InviteLink = chatInviteUrl + result.Stamp
+	}
+
+	return info
+}
+
+func chatAdmins(members []*getChatMembersRspResultMember) (admins []string) {
+	for _, v := range members {
+		if v.Role == "admin" || v.Role == "moder" {
+			admins = append(admins, v.Sn)
+		}
+	}
+
+	return admins
+}
+
+// downloadAvatar saves the avatar image next to attachments of the chat, chats without avatars are skipped;
+// images are not captured, so avatars are not downloaded by replays
+func (m *ICQApi) downloadAvatar(ctx context.Context, chatId string, info *mongodb.CollectionChatsInfo) (e error) {
+	if m.replay != nil {
+		return nil
+	}
+
+	var dir = filepath.Join(m.attachmentsDir, safeFileName(chatId))
+	if e = os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+
+	var req *http.Request
+	if req, e = http.NewRequestWithContext(ctx, "GET", info.AvatarUrl, nil); e != nil {
+		return e
+	}
+
+	if e = m.limiter.wait(ctx); e != nil {
+		return e
+	}
+
+	var rsp *http.Response
+	var started = time.Now()
+	rsp, e = downloadClient.Do(req)
+	gMetrics.observeAPI("avatar", started, rsp, e)
+	if e != nil {
+		return e
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil
+	} else if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("avatar server responded with %s", rsp.Status)
+	}
+
+	var ext = ".jpg"
+	if exts, _ := mime.ExtensionsByType(rsp.Header.Get("Content-Type")); len(exts) != 0 {
+		ext = exts[0]
+	}
+
+	info.AvatarFile, e = saveDownload(dir, "avatar"+ext, rsp.Body)
+	return e
+}
+
+// dumpChatsInfo stores the info and members of selected group chats; admins of the info are taken
+// from the member list, they are kept as stored if members could not be fetched; failures other than
+// the expired session are logged and do not stop the dump
+func (m *ICQApi) dumpChatsInfo(ctx context.Context, chatIds []string) (e error) {
+	for _, v := range chatIds {
+		if !isGroupChat(v) {
+			continue
+		}
+
+		var members []*getChatMembersRspResultMember
+		var membersErr error
+		if members, membersErr = m.getChatMembers(ctx, v); errors.Is(membersErr, ErrAuthExpired) {
+			return membersErr
+		} else if membersErr != nil {
+			gLogger.Warn().Err(membersErr).Str("chatId", chatRef{m.account, v}.String()).Msg("Could not fetch chat members")
+		} else if e = saveChatMembers(ctx, v, members); e != nil {
+			return e
+		}
+
+		var result *getChatInfoRspResult
+		if result, e = m.getChatInfo(ctx, v); errors.Is(e, ErrAuthExpired) {
+			return e
+		} else if e != nil {
+			gLogger.Warn().Err(e).Str("chatId", chatRef{m.account, v}.String()).Msg("Could not fetch chat info")
+			continue
+		}
+
+		var info = m.newChatInfo(result)
+		if membersErr == nil {
+			info.Admins = chatAdmins(members)
+		}
+
+		if m.attachmentsDir != "" {
+			if e = m.downloadAvatar(ctx, v, info); e != nil {
+				gLogger.Warn().Err(e).Str("chatId", v).Msg("Could not download chat avatar")
+			}
+		}
+
+		if e = saveChatInfo(ctx, v, info, membersErr == nil); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// chatInfoChanges returns names of info fields which differ, the update time and the avatar file are ignored
+func chatInfoChanges(previous, info *mongodb.CollectionChatsInfo) (fields []string) {
+	var prev, next = reflect.ValueOf(*previous), reflect.ValueOf(*info)
+	for i := 0; i < next.NumField(); i++ {
+		var field = next.Type().Field(i)
+		if field.Name == "UpdatedAt" || field.Name == "AvatarFile" {
+			continue
+		}
+
+		if !reflect.DeepEqual(prev.Field(i).Interface(), next.Field(i).Interface()) {
+			fields = append(fields, strings.SplitN(field.Tag.Get("bson"), ",", 2)[0])
+		}
+	}
+
+	return fields
+}
+
+// saveChatInfo replaces the stored info of the chat, the chat document is created if it is missing;
+// the replaced info is pushed to the history with changed fields, unchanged info only updates its time
+func saveChatInfo(ctx context.Context, chatId string, info *mongodb.CollectionChatsInfo, adminsKnown bool) (e error) {
+	var stored = new(mongodb.CollectionChats)
+	e = gMongoDB.FindOne(ctx, "chats", bson.M{"aimId": chatId, "info": bson.M{"$exists": true}}, stored,
+		options.FindOne().SetSort(bson.M{"_id": -1}).SetProjection(bson.M{"info": 1}))
+	if e != nil && e != mongo.ErrNoDocuments {
+		return e
+	}
+
+	if info.AvatarFile == "" && stored.Info != nil {
+		info.AvatarFile = stored.Info.AvatarFile
+	}
+	if !adminsKnown && stored.Info != nil {
+		info.Admins = stored.Info.Admins
+	}
+
+	var update = bson.M{
+		"$set":         bson.M{"info": info},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "name": info.Name},
+	}
+	if stored.Info != nil {
+		if fields := chatInfoChanges(stored.Info, info); len(fields) != 0 {
+			update["$push"] = bson.M{"infoHistory": &mongodb.CollectionChatsInfoChange{
+				ChangedAt: info.UpdatedAt,
+				Fields:    fields,
+				Previous:  stored.Info,
+			}}
+
+			gLogger.Info().Str("chatId", chatId).Strs("fields", fields).Msg("Chat info has been changed")
+		}
+	}
+
+	_, e = gMongoDB.BulkWrite(ctx, "chats", []mongo.WriteModel{
+		mongo.NewUpdateManyModel().SetFilter(bson.M{"aimId": chatId}).SetUpdate(update).SetUpsert(true),
+	})
+	return e
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+)
+
+func TestChatInfoChanges(t *testing.T) {
+	var previous = mongodb.CollectionChatsInfo{
+		Name:         "Team",
+		About:        "Team chat",
+		Creator:      "10001",
+		Admins:       []string{"10001", "10002"},
+		MembersCount: 4,
+		AvatarFile:   "avatar.jpg",
+		UpdatedAt:    time.Unix(1000, 0),
+	}
+
+	var tests = []struct {
+		name   string
+		change func(info *mongodb.CollectionChatsInfo)
+		fields []string
+	}{
+		{"unchanged", func(info *mongodb.CollectionChatsInfo) {}, nil},
+		{"update time and avatar file", func(info *mongodb.CollectionChatsInfo) {
+			info.UpdatedAt, info.AvatarFile = time.Now(), ""
+		}, nil},
+		{"renamed", func(info *mongodb.CollectionChatsInfo) { info.Name = "Team 2" }, []string{"name"}},
+		{"admins and members", func(info *mongodb.CollectionChatsInfo) {
+			info.Admins, info.MembersCount = []string{"10001"}, 5
+		}, []string{"admins", "membersCount"}},
+		{"made public", func(info *mongodb.CollectionChatsInfo) {
+			info.Public, info.InviteLink = true, chatInviteUrl+"stamp"
+		}, []string{"public", "inviteLink"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prev, info = previous, previous
+			info.Admins = append([]string(nil), previous.Admins...)
+			tt.change(&info)
+
+			if fields := chatInfoChanges(&prev, &info); !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("got changed fields %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	chatMatchAll   = "all"
+	chatMatchAimId = "aimId"
+	chatMatchGroup = "group"
+	chatMatchName  = "name"
+	chatMatchRegex = "re"
+)
+
+type (
+	// ChatSelector selects chats by values of the form:
+	// all, <aimId>, group:<glob>, name:<glob>, re:<regexp on chat name>
+	ChatSelector struct {
+		Include, Exclude []string
+	}
+	chatMatcher struct {
+		kind, value string
+		re          *regexp.Regexp
+	}
+)
+
+func newChatMatcher(value string) (m *chatMatcher, e error) {
+	m = &chatMatcher{kind: chatMatchAimId, value: value}
+
+	if value == chatMatchAll {
+		m.kind = chatMatchAll
+		return m, nil
+	}
+
+	if i := strings.Index(value, ":"); i != -1 {
+		switch value[:i] {
+		case chatMatchGroup, chatMatchName:
+			m.kind, m.value = value[:i], value[i+1:]
+			_, e = path.Match(m.value, "")
+		case chatMatchRegex:
+			m.kind, m.value = value[:i], value[i+1:]
+			m.re, e = regexp.Compile(m.value)
+		}
+	}
+
+	if e != nil {
+		return nil, fmt.Errorf("Invalid chat pattern %q: %w", value, e)
+	}
+
+	return m, e
+}
+
+func (m *chatMatcher) match(chat *buddyChat) bool {
+	switch m.kind {
+	case chatMatchAll:
+		return true
+	case chatMatchGroup:
+		for _, v := range chat.Groups {
+			if ok, _ := path.Match(m.value, v); ok {
+				return true
+			}
+		}
+		return false
+	case chatMatchName:
+		var ok, _ = path.Match(m.value, chat.Name)
+		return ok
+	case chatMatchRegex:
+		return m.re.MatchString(chat.Name)
+	default:
+		return m.value == chat.AimId
+	}
+}
+
+func compileChatMatchers(values []string) (matchers []*chatMatcher, e error) {
+	for _, v := range values {
+		var matcher *chatMatcher
+		if matcher, e = newChatMatcher(v); e != nil {
+			return nil, e
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, e
+}
+
+func (m *ChatSelector) Validate() (e error) {
+	if len(m.Include) == 0 {
+		return errors.New("Chats for dumping are not given!")
+	}
+
+	if _, e = compileChatMatchers(m.Include); e != nil {
+		return e
+	}
+
+	_, e = compileChatMatchers(m.Exclude)
+	return e
+}
+
+// selectChats resolves the selector; the buddy list is requested only for non aimId values and
+// returned as buddies, it is nil otherwise
+func (m *App) selectChats(ctx context.Context, api *ICQApi, selector *ChatSelector) (chats, buddies []*buddyChat, e error) {
+	var include, exclude []*chatMatcher
+	if include, e = compileChatMatchers(selector.Include); e != nil {
+		return nil, nil, e
+	}
+	if exclude, e = compileChatMatchers(selector.Exclude); e != nil {
+		return nil, nil, e
+	}
+
+	for _, v := range append(include, exclude...) {
+		if v.kind != chatMatchAimId {
+			if buddies, e = api.getChats(ctx); e != nil {
+				return nil, nil, e
+			}
+			break
+		}
+	}
+
+	var selected = make(map[string]bool)
+	var add = func(chat *buddyChat) {
+		if selected[chat.AimId] {
+			return
+		}
+
+		for _, v := range exclude {
+			if v.match(chat) {
+				return
+			}
+		}
+
+		selected[chat.AimId] = true
+		chats = append(chats, chat)
+	}
+
+	for _, v := range include {
+		var found bool
+		for _, buddy := range buddies {
+			if v.match(buddy) {
+				found = true
+				add(buddy)
+			}
+		}
+
+		// chats given by aimId are dumped even if they are not in the buddy list
+		if !found && v.kind == chatMatchAimId {
+			add(&buddyChat{AimId: v.value, Account: api.account})
+		}
+	}
+
+	gLogger.Info().Str("account", api.account).Int("chats", len(chats)).Int("buddy list", len(buddies)).
+		Msg("Chats have been successfully selected")
+	return chats, buddies, e
+}
+
+// ListChats prints chats selected by the selector without dumping them
+func (m *App) ListChats(w io.Writer, selector *ChatSelector) (e error) {
+	if e = m.setupAccounts(context.Background(), ""); e != nil {
+		return e
+	}
+	defer m.closeCapture()
+
+	var chats []*buddyChat
+	for _, api := range m.accounts.sorted() {
+		var selected []*buddyChat
+		if selected, _, e = m.selectChats(context.Background(), api, selector); e != nil {
+			return e
+		}
+		chats = append(chats, selected...)
+	}
+
+	var tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tAIMID\tNAME\tGROUP")
+	for _, v := range chats {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.Account, v.AimId, v.Name, strings.Join(v.Groups, ","))
+	}
+
+	if e = tw.Flush(); e != nil {
+		return e
+	}
+
+	_, e = fmt.Fprintf(w, "\n%d chats selected\n", len(chats))
+	return e
+}
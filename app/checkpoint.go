@@ -0,0 +1,225 @@
+package app
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// readonly checkpoints of bounded dumps are neither loaded nor saved
+	checkpoints struct {
+		sync.Mutex
+		chats    map[chatRef]*chatCheckpoint
+		restart  bool
+		readonly bool
+	}
+	// chatCheckpoint advances saved only by contiguous pages: a page saved
+	// before its predecessor is held in pages until the gap is closed
+	chatCheckpoint struct {
+		start     uint64
+		fetched   uint64
+		saved     uint64
+		completed bool
+		pages     map[uint64]uint64
+
+		messagesFetched, messagesSaved int64
+
+		// backward chains go from the newest message (0) to older page boundaries
+		backward bool
+	}
+)
+
+func newCheckpoints(restart, readonly bool) *checkpoints {
+	return &checkpoints{
+		chats:    make(map[chatRef]*chatCheckpoint),
+		restart:  restart,
+		readonly: readonly,
+	}
+}
+
+// load returns msgId the chat dump should be continued from
+func (m *checkpoints) load(ctx context.Context, chat chatRef) (fromMsgId uint64, e error) {
+	fromMsgId = 1
+
+	// retried chat jobs continue from the last pushed message
+	m.Lock()
+	if cp, ok := m.chats[chat]; ok {
+		m.Unlock()
+		return cp.fetched, nil
+	}
+	m.Unlock()
+
+	// the stored checkpoint could be past the window of the bounded dump
+	if !m.restart && !m.readonly {
+		var stored = new(mongodb.CollectionCheckpoints)
+		if e = gMongoDB.FindOne(ctx, "checkpoints", chat.filter(), stored); e != nil && e != mongo.ErrNoDocuments {
+			return 0, e
+		} else if e == nil && stored.LastMsgId != 0 {
+			fromMsgId = stored.LastMsgId
+		}
+	}
+
+	m.Lock()
+	m.chats[chat] = newChatCheckpoint(fromMsgId)
+	m.Unlock()
+
+	return fromMsgId, nil
+}
+
+func newChatCheckpoint(fromMsgId uint64) *chatCheckpoint {
+	return &chatCheckpoint{
+		start:   fromMsgId,
+		fetched: fromMsgId,
+		saved:   fromMsgId,
+		pages:   make(map[uint64]uint64),
+	}
+}
+
+// tail starts the backward chain of the chat
+func (m *checkpoints) tail(chat chatRef) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.chats[chat] = newChatCheckpoint(0)
+	m.chats[chat].backward = true
+}
+
+func (m *checkpoints) get(chat chatRef) *chatCheckpoint {
+	if cp, ok := m.chats[chat]; ok {
+		return cp
+	}
+
+	m.chats[chat] = newChatCheckpoint(1)
+	return m.chats[chat]
+}
+
+func (m *checkpoints) fetched(chat chatRef, msgId uint64, messages int) {
+	m.Lock()
+	defer m.Unlock()
+
+	var cp = m.get(chat)
+	cp.messagesFetched += int64(messages)
+	if cp.backward || msgId > cp.fetched {
+		cp.fetched = msgId
+	}
+}
+
+// saved marks the page fetched from fromMsgId up to lastMsgId as written
+func (m *checkpoints) saved(chat chatRef, fromMsgId, lastMsgId uint64, messages int) {
+	m.Lock()
+	defer m.Unlock()
+
+	var cp = m.get(chat)
+	cp.messagesSaved += int64(messages)
+	cp.pages[fromMsgId] = lastMsgId
+
+	for {
+		var last, ok = cp.pages[cp.saved]
+		if !ok {
+			break
+		}
+
+		delete(cp.pages, cp.saved)
+		cp.saved = last
+	}
+
+	if cp.done() {
+		gChatSpans.end(chat)
+	}
+}
+
+func (m *checkpoints) complete(chat chatRef) {
+	m.Lock()
+	defer m.Unlock()
+
+	var cp = m.get(chat)
+	cp.completed = true
+
+	if cp.done() {
+		gChatSpans.end(chat)
+	}
+}
+
+func (m *chatCheckpoint) done() bool {
+	return m.completed && m.saved == m.fetched
+}
+
+func (m *checkpoints) persist(ctx context.Context) (e error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.readonly {
+		gLogger.Info().Msg("Checkpoints are not saved for time-bounded dumps")
+		return nil
+	}
+
+	for chat, cp := range m.chats {
+		var lastMsgId = cp.saved
+		if lastMsgId <= cp.start && !cp.completed {
+			continue
+		}
+
+		if e = gMongoDB.UpdateOne(ctx, "checkpoints", chat.filter(), bson.M{
+			"$set": &mongodb.CollectionCheckpoints{
+				AimId:     chat.chatId,
+				Account:   chat.account,
+				LastMsgId: lastMsgId,
+				Completed: cp.done(),
+				UpdatedAt: time.Now(),
+			},
+		}, options.Update().SetUpsert(true)); e != nil {
+			return e
+		}
+
+		gLogger.Debug().Str("chatId", chat.String()).Uint64("lastMsgId", lastMsgId).Msg("Checkpoint has been saved")
+	}
+
+	return e
+}
+
+// runChats returns per-chat results of the current run sorted by aimId and account
+func (m *checkpoints) runChats() (chats []mongodb.CollectionRunsChat) {
+	m.Lock()
+	defer m.Unlock()
+
+	for chat, cp := range m.chats {
+		chats = append(chats, mongodb.CollectionRunsChat{
+			AimId:           chat.chatId,
+			Account:         chat.account,
+			MessagesFetched: cp.messagesFetched,
+			MessagesSaved:   cp.messagesSaved,
+			Checkpoint:      cp.saved,
+			Completed:       cp.done(),
+		})
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		if chats[i].AimId == chats[j].AimId {
+			return chats[i].Account < chats[j].Account
+		}
+		return chats[i].AimId < chats[j].AimId
+	})
+	return chats
+}
+
+func (m *checkpoints) report() {
+	m.Lock()
+	defer m.Unlock()
+
+	for chat, cp := range m.chats {
+		if cp.done() {
+			continue
+		}
+
+		gLogger.Warn().Str("chatId", chat.String()).Uint64("checkpoint", cp.saved).Uint64("fetched", cp.fetched).
+			Int("held pages", len(cp.pages)).Bool("fetch completed", cp.completed).
+			Msg("Chat has not been dumped completely")
+	}
+}
@@ -0,0 +1,88 @@
+package app
+
+import "testing"
+
+// pages saved out of order are held until the gap before them is closed
+func TestCheckpointSavedIsContiguous(t *testing.T) {
+	gChatSpans = newChatSpans()
+	var chat = chatRef{"work", "100@chat.agent"}
+
+	var tests = []struct {
+		name  string
+		pages [][2]uint64
+		saved uint64
+		held  int
+	}{
+		{"in order", [][2]uint64{{1, 10}, {10, 20}, {20, 30}}, 30, 0},
+		{"gap is held", [][2]uint64{{1, 10}, {20, 30}}, 10, 1},
+		{"gap is closed", [][2]uint64{{10, 20}, {20, 30}, {1, 10}}, 30, 0},
+		{"first page is missing", [][2]uint64{{10, 20}, {20, 30}}, 1, 2},
+		{"page saved twice", [][2]uint64{{1, 10}, {1, 10}, {10, 20}}, 20, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cps = newCheckpoints(true, false)
+			cps.chats[chat] = newChatCheckpoint(1)
+
+			for _, v := range tt.pages {
+				cps.fetched(chat, v[1], 1)
+				cps.saved(chat, v[0], v[1], 1)
+			}
+
+			var cp = cps.chats[chat]
+			if cp.saved != tt.saved || len(cp.pages) != tt.held {
+				t.Errorf("got checkpoint %d with %d held pages, want %d with %d", cp.saved, len(cp.pages), tt.saved, tt.held)
+			}
+			if cp.messagesSaved != int64(len(tt.pages)) {
+				t.Errorf("got %d saved messages, want %d", cp.messagesSaved, len(tt.pages))
+			}
+		})
+	}
+}
+
+// backward chains start from the newest message and go to older page boundaries
+func TestCheckpointTail(t *testing.T) {
+	gChatSpans = newChatSpans()
+	var chat = chatRef{"work", "100@chat.agent"}
+
+	var tests = []struct {
+		name      string
+		fetched   []uint64
+		pages     [][2]uint64
+		completed bool
+		saved     uint64
+		done      bool
+	}{
+		{"newest page", []uint64{500}, [][2]uint64{{0, 500}}, false, 500, false},
+		{"older pages", []uint64{500, 400, 300}, [][2]uint64{{0, 500}, {500, 400}, {400, 300}}, true, 300, true},
+		{"older page saved first", []uint64{500, 400}, [][2]uint64{{500, 400}, {0, 500}}, true, 400, true},
+		{"newest page missing", []uint64{500, 400}, [][2]uint64{{500, 400}}, true, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cps = newCheckpoints(false, true)
+			cps.chats[chat] = newChatCheckpoint(1)
+			cps.tail(chat)
+
+			for _, v := range tt.fetched {
+				cps.fetched(chat, v, 1)
+			}
+			for _, v := range tt.pages {
+				cps.saved(chat, v[0], v[1], 1)
+			}
+			if tt.completed {
+				cps.complete(chat)
+			}
+
+			var cp = cps.chats[chat]
+			if !cp.backward || cp.start != 0 {
+				t.Fatalf("tail has not restarted the chain: start %d, backward %v", cp.start, cp.backward)
+			}
+			if cp.saved != tt.saved || cp.done() != tt.done {
+				t.Errorf("got checkpoint %d done %v, want %d done %v", cp.saved, cp.done(), tt.saved, tt.done)
+			}
+		})
+	}
+}
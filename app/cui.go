@@ -3,57 +3,197 @@ package app
 import (
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/MindHunter86/icqdumper/system/mongodb"
 	"github.com/jroimartin/gocui"
+	"github.com/rs/zerolog"
 )
 
+const cuiLogLines = 1000
+
 type (
 	AppCui struct {
 		cui     *gocui.Gui
 		buffer1 io.Writer
+
+		progress func() *progressSnapshot
+		log      *cuiLog
+		quitOnce sync.Once
+		done     chan struct{}
+
+		// browse mode
+		exportDir string
+		chats     []*mongodb.CollectionChats
+		chat      *mongodb.CollectionChats
+		lines     []string
+		msgLines  []int
+		search    string
+		prompt    uint8
+		status    string
+	}
+	// cuiLog holds log lines while the terminal UI owns the screen, the progress view shows their tail;
+	// held lines are written to out when the UI is closed, so errors and the summary stay in the scrollback
+	cuiLog struct {
+		sync.Mutex
+		out   io.Writer
+		lines []string
+		held  bool
 	}
 )
 
+func newCuiLog(out io.Writer) *cuiLog {
+	return &cuiLog{
+		out:  out,
+		held: true,
+	}
+}
+
+// logger returns the logger writing to the log holder; it is set up before any goroutine captures gLogger
+func (m *cuiLog) logger(l *zerolog.Logger) *zerolog.Logger {
+	var log = l.Output(zerolog.ConsoleWriter{Out: m, NoColor: true}).With().Logger()
+	return &log
+}
+
+func (m *cuiLog) Write(p []byte) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.held {
+		return m.out.Write(p)
+	}
+
+	m.lines = append(m.lines, strings.Split(strings.TrimRight(string(p), "\n"), "\n")...)
+	if len(m.lines) > cuiLogLines {
+		m.lines = m.lines[len(m.lines)-cuiLogLines:]
+	}
+
+	return len(p), nil
+}
+
+func (m *cuiLog) tail(count int) []string {
+	m.Lock()
+	defer m.Unlock()
+
+	if count < 0 {
+		count = 0
+	}
+	if len(m.lines) < count {
+		count = len(m.lines)
+	}
+
+	return append([]string(nil), m.lines[len(m.lines)-count:]...)
+}
+
+// release writes held lines to out, following lines are written there directly
+func (m *cuiLog) release() (e error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.held = false
+	for _, v := range m.lines {
+		if _, e = fmt.Fprintln(m.out, v); e != nil {
+			return e
+		}
+	}
+
+	m.lines = nil
+	return e
+}
+
 func NewAppCui() *AppCui {
-	return &AppCui{}
+	return &AppCui{
+		done: make(chan struct{}),
+	}
 }
 
-func (m *AppCui) Bootstrap() (*AppCui, error) {
-	var e error
+func (m *AppCui) Bootstrap(progress func() *progressSnapshot, log *cuiLog) (e error) {
+	m.progress, m.log = progress, log
+
 	if m.cui, e = gocui.NewGui(gocui.OutputNormal); e != nil {
-		return nil, e
+		return e
 	}
 	defer m.cui.Close()
 
 	m.cui.SetManagerFunc(m.layout)
 
 	if e = m.cui.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, m.quit); e != nil {
-		return nil, e
+		return e
 	}
 
+	go m.refresh(time.Second)
+
 	if e = m.cui.MainLoop(); e != nil && e != gocui.ErrQuit {
-		return nil, e
+		return e
 	}
 
-	return nil, e
+	return nil
+}
+
+func (m *AppCui) refresh(interval time.Duration) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			m.cui.Update(m.quitUpdate)
+			return
+		case <-ticker.C:
+			m.cui.Update(func(*gocui.Gui) error { return nil })
+		}
+	}
 }
 
 func (m *AppCui) layout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
 
-	if view, e := g.SetView("hello", 1, 1, maxX-1, maxY-1); e != nil {
+	var split = maxY - 1
+	if m.log != nil {
+		split = maxY / 2
+	}
+
+	view, e := g.SetView("progress", 1, 1, maxX-1, split)
+	if e != nil {
 		if e != gocui.ErrUnknownView {
 			return e
 		}
 
+		view.Title = "icqdumper"
 		m.buffer1 = view
-		fmt.Fprintln(view, "Hello Worlddddddddddddddddd!")
-		fmt.Fprintln(view, maxX, maxY)
+	}
+
+	view.Clear()
+	if m.progress != nil {
+		for _, v := range m.progress().lines() {
+			fmt.Fprintln(view, v)
+		}
+	}
+
+	if m.log == nil {
+		return nil
+	}
+
+	var logView *gocui.View
+	if logView, e = g.SetView("log", 1, split+1, maxX-1, maxY-1); e != nil {
+		if e != gocui.ErrUnknownView {
+			return e
+		}
+
+		logView.Title = "log"
+	}
+
+	logView.Clear()
+	for _, v := range m.log.tail(maxY - split - 3) {
+		fmt.Fprintln(logView, v)
 	}
 
 	return nil
 }
 
 func (m *AppCui) quit(g *gocui.Gui, v *gocui.View) error { return gocui.ErrQuit }
+func (m *AppCui) quitUpdate(g *gocui.Gui) error          { return gocui.ErrQuit }
 func (m *AppCui) GetBuffer() io.Writer                   { return m.buffer1 }
-func (m *AppCui) Destroy()                               { m.cui.Close() }
+func (m *AppCui) Destroy()                               { m.quitOnce.Do(func() { close(m.done) }) }
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type DeadLetterFilter struct {
+	IDs         []string
+	Type, Queue string
+	All         bool
+}
+
+func (m *DeadLetterFilter) bson() bson.M {
+	var filter = bson.M{}
+	if len(m.IDs) != 0 {
+		filter["_id"] = bson.M{"$in": m.IDs}
+	}
+	if m.Type != "" {
+		filter["type"] = m.Type
+	}
+	if m.Queue != "" {
+		filter["queue"] = m.Queue
+	}
+
+	return filter
+}
+
+func (m *App) ListFailed(w io.Writer, filter *DeadLetterFilter) (e error) {
+	if e = m.connectMongoDB(); e != nil {
+		return e
+	}
+	defer gMongoDB.Destruct()
+
+	var records []*mongodb.CollectionJobs
+	if e = gMongoDB.Find(context.Background(), "jobs_dead", filter.bson(), &records,
+		options.Find().SetSort(bson.M{"updatedAt": 1})); e != nil {
+		return e
+	}
+
+	var tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tQUEUE\tTYPE\tATTEMPTS\tFAILED AT\tLAST ERROR\tPAYLOAD")
+	for _, v := range records {
+		var lastError string
+		if len(v.Errors) != 0 {
+			lastError = v.Errors[len(v.Errors)-1].Error
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", v.ID, v.Queue, v.Type, v.Attempts,
+			v.UpdatedAt.Local().Format("2006-01-02 15:04:05"), lastError, v.Description)
+	}
+
+	if e = tw.Flush(); e != nil {
+		return e
+	}
+
+	_, e = fmt.Fprintf(w, "\n%d failed jobs\n", len(records))
+	return e
+}
+
+// RetryFailed moves dead letters back to the persistent queue and runs it until they are processed
+func (m *App) RetryFailed(filter *DeadLetterFilter) (e error) {
+	if len(filter.IDs) == 0 && !filter.All {
+		return errors.New("Job IDs are not given! Use --all for retrying every failed job")
+	}
+
+	if e = m.connectMongoDB(); e != nil {
+		return e
+	}
+
+	var count int
+	if count, e = m.requeueFailed(context.Background(), filter); e != nil {
+		gMongoDB.Destruct()
+		return e
+	}
+
+	gMongoDB.Destruct()
+	gLogger.Info().Int("jobs", count).Msg("Failed jobs have been moved back to the persistent queue")
+
+	if count == 0 {
+		return nil
+	}
+
+	m.params.QueueBackend = QueueBackendMongoDB
+	return m.Bootstrap(nil)
+}
+
+func (m *App) requeueFailed(ctx context.Context, filter *DeadLetterFilter) (count int, e error) {
+	var records []*mongodb.CollectionJobs
+	if e = gMongoDB.Find(ctx, "jobs_dead", filter.bson(), &records); e != nil {
+		return 0, e
+	}
+
+	for _, v := range records {
+		v.Status = jobRecordReady
+		v.Attempts = 0
+		v.LeasedBy = ""
+		v.VisibleAt = time.Now()
+		v.UpdatedAt = time.Now()
+
+		var record interface{} = v
+		if e = gMongoDB.InsertOne(ctx, "jobs", &record); e != nil {
+			return count, e
+		}
+
+		if e = gMongoDB.DeleteOne(ctx, "jobs_dead", bson.M{"_id": v.ID}); e != nil {
+			return count, e
+		}
+
+		count++
+	}
+
+	return count, e
+}
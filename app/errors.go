@@ -0,0 +1,103 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+// classes of ICQ API status errors, apiError wraps one of them
+var (
+	ErrAuthExpired = errors.New("ICQ session is expired or invalid")
+	ErrRateLimited = errors.New("ICQ API rate limit is exceeded")
+	ErrNotFound    = errors.New("ICQ API object is not found")
+	ErrServer      = errors.New("ICQ API server error")
+	ErrBadRequest  = errors.New("ICQ API has rejected the request")
+)
+
+type (
+	// apiError is the non successful status of the HTTP response or of the JSON response body
+	apiError struct {
+		class   error
+		method  string
+		account string
+		code    int
+		reason  string
+	}
+)
+
+// newAPIError classifies the status code of the method response, it returns nil for successful and absent codes;
+// rapi codes are HTTP codes multiplied by 100 (20000, 40100), WIM uses HTTP codes and 607 for rate limits
+func newAPIError(method, account string, code int, reason string) error {
+	var status = code
+	if status >= 10000 {
+		status /= 100
+	}
+
+	var class error
+	switch {
+	case status == 0, status >= 200 && status < 300:
+		return nil
+	case status == 401 || status == 403:
+		class = ErrAuthExpired
+	case status == 404:
+		class = ErrNotFound
+	case status == 429 || status == 607:
+		class = ErrRateLimited
+	case status >= 500 && status < 600:
+		class = ErrServer
+	default:
+		class = ErrBadRequest
+	}
+
+	return &apiError{
+		class:   class,
+		method:  method,
+		account: account,
+		code:    code,
+		reason:  reason,
+	}
+}
+
+func (m *apiError) Error() string {
+	var msg = fmt.Sprintf("%s: %s responded with status %d", m.class, m.method, m.code)
+	if m.reason != "" {
+		msg += " " + m.reason
+	}
+	if m.account != "" {
+		msg += " for account " + m.account
+	}
+	if m.class == ErrAuthExpired {
+		msg += "; run the login command or give a new AIMSID"
+	}
+
+	return msg
+}
+
+func (m *apiError) Unwrap() error { return m.class }
+
+// retryable reports whether the failed job may succeed on the next attempt; network and storage
+// errors are retried, API errors only for rate limits and server failures, invalid responses are not
+func retryable(e error) bool {
+	if errors.Is(e, errValidation) {
+		return false
+	}
+
+	var apiErr *apiError
+	if !errors.As(e, &apiErr) {
+		return true
+	}
+
+	return apiErr.class == ErrRateLimited || apiErr.class == ErrServer
+}
+
+// abortRun stops the run on errors that fail every following job, such as the expired session
+func abortRun(e error) {
+	if gAbort == nil {
+		return
+	}
+
+	select {
+	case gAbort <- e:
+	default:
+	}
+}
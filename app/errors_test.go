@@ -0,0 +1,58 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNewAPIError(t *testing.T) {
+	var tests = []struct {
+		code      int
+		class     error
+		retryable bool
+	}{
+		{0, nil, false},
+		{200, nil, false},
+		{20000, nil, false},
+		{401, ErrAuthExpired, false},
+		{40100, ErrAuthExpired, false},
+		{403, ErrAuthExpired, false},
+		{404, ErrNotFound, false},
+		{40400, ErrNotFound, false},
+		{429, ErrRateLimited, true},
+		{607, ErrRateLimited, true},
+		{500, ErrServer, true},
+		{50300, ErrServer, true},
+		{400, ErrBadRequest, false},
+		{46000, ErrBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.code), func(t *testing.T) {
+			var e = newAPIError("getHistory", "work", tt.code, "reason")
+			if tt.class == nil {
+				if e != nil {
+					t.Errorf("got error %v, want nil", e)
+				}
+				return
+			}
+
+			if !errors.Is(e, tt.class) {
+				t.Errorf("got error %v, want class %v", e, tt.class)
+			}
+			if retryable(fmt.Errorf("job: %w", e)) != tt.retryable {
+				t.Errorf("got retryable %v for %v, want %v", !tt.retryable, e, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestRetryableNonAPIErrors(t *testing.T) {
+	if !retryable(errors.New("connection reset by peer")) {
+		t.Error("network errors must be retried")
+	}
+	if retryable(newValidationError("getHistory", "messages", "is missing")) {
+		t.Error("invalid responses must not be retried")
+	}
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+)
+
+func safeFileName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+}
+
+func formatMessageLines(message *mongodb.CollectionChatsMessage) (lines []string) {
+	var header = fmt.Sprintf("[%s] %s: ", message.Time.Local().Format("2006-01-02 15:04:05"), message.Sender)
+
+	for i, v := range strings.Split(message.Text, "\n") {
+		if i == 0 {
+			lines = append(lines, header+v)
+		} else {
+			lines = append(lines, strings.Repeat(" ", len(header))+v)
+		}
+	}
+
+	return lines
+}
+
+func exportChat(w io.Writer, chat *mongodb.CollectionChats) (e error) {
+	if _, e = fmt.Fprintf(w, "# %s (%s)\n\n", chat.Name, chat.AimId); e != nil {
+		return e
+	}
+
+	if chat.Info != nil {
+		if e = exportChatInfo(w, chat.Info); e != nil {
+			return e
+		}
+	}
+
+	for i := range chat.Messages {
+		for _, v := range formatMessageLines(&chat.Messages[i]) {
+			if _, e = fmt.Fprintln(w, v); e != nil {
+				return e
+			}
+		}
+	}
+
+	return e
+}
+
+func exportChatInfo(w io.Writer, info *mongodb.CollectionChatsInfo) (e error) {
+	var visibility = "private"
+	if info.Public {
+		visibility = "public"
+	}
+
+	var lines = []string{
+		fmt.Sprintf("Members: %d, %s", info.MembersCount, visibility),
+	}
+	if info.Creator != "" {
+		lines = append(lines, "Creator: "+info.Creator)
+	}
+	if len(info.Admins) != 0 {
+		lines = append(lines, "Admins: "+strings.Join(info.Admins, ", "))
+	}
+	if info.InviteLink != "" {
+		lines = append(lines, "Invite link: "+info.InviteLink)
+	}
+	if info.AvatarFile != "" {
+		lines = append(lines, "Avatar: "+info.AvatarFile)
+	} else if info.AvatarUrl != "" {
+		lines = append(lines, "Avatar: "+info.AvatarUrl)
+	}
+	if info.About != "" {
+		lines = append(lines, "", info.About)
+	}
+	if info.Rules != "" {
+		lines = append(lines, "", "Rules:", info.Rules)
+	}
+
+	_, e = fmt.Fprintf(w, "%s\n\n", strings.Join(lines, "\n"))
+	return e
+}
+
+func exportChatToFile(dir string, chat *mongodb.CollectionChats) (path string, e error) {
+	path = filepath.Join(dir, safeFileName(chat.AimId)+".txt")
+
+	var fd *os.File
+	if fd, e = os.Create(path); e != nil {
+		return "", e
+	}
+	defer fd.Close()
+
+	if e = exportChat(fd, chat); e != nil {
+		return "", e
+	}
+
+	return path, fd.Sync()
+}
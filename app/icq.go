@@ -2,105 +2,34 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	mongodb "github.com/MindHunter86/icqdumper/system/mongodb"
 	uuid "github.com/satori/go.uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type (
 	ICQApi struct {
-		aimsid string
-		client *http.Client
-	}
-
-	icqApiResponse struct {
-		Timestamp int64           `json:"ts,omitempty"`
-		Status    *responseStatus `json:"status,omitempty"`
-		Method    string          `json:"method,omitempty"`
-		ReqId     string          `json:"reqId,omitempty"`
-		Results   *responseResult `json:"results,omitempty"`
-	}
-
-	responseStatus struct {
-		Code int `json:"code,omitempty"`
-	}
-
-	responseResult struct {
-		Messages     []*resultMessage `json:"messages,omitempty"`
-		LastMsgId    int              `json:"lastMsgId,omitempty"`
-		PatchVersion string           `json:"patchVersion,omitempty"`
-		Yours        *resultYours     `json:"yours,omitempty"`
-		Unreads      int              `json:"ureads,omitempty"`
-		UnreadCnt    int              `json:"unreadCnt,omitempty"`
-		Patch        []*resultPatch   `json:"patch,omitempty"`
-		Persons      []*resultPerson  `json:"persons,omitempty"`
-	}
-
-	resultYours struct {
-		LastRead        int `json:"lastRead,omitempty"`
-		LastDelivered   int `json:"lastDelivered,omitempty"`
-		LastReadMention int `json:"lastReadMention,omitempty"`
-	}
-
-	resultPatch struct {
-		MsgId   uint64 `json:"msgId,omitempty"`
-		Pa_type string `json:"type,omitempty"`
-	}
-
-	resultPerson struct {
-		Sn        string `json:"sn,omitempty"`
-		Role      string `json:"role,omitempty"`
-		Friendly  string `json:"friendly,omitempty"`
-		FirstName string `json:"firstName,omitempty"`
-		LastName  string `json:"lastName,omitempty"`
-		Nick      string `json:"nick,omitempty"`
-		NickName  string `json:"nickname,omitempty"`
-	}
-
-	resultMessage struct {
-		ReadsCount int          `json:"-"`
-		MsgId      uint64       `json:"msgId,omitempty"`
-		Time       int          `json:"time,omitempty"`
-		Wid        string       `json:"wid,omitempty"`
-		Chat       *messageChat `json:"chat,omitempty"`
-		Text       string       `json:"text,omitempty"`
-		Outgoing   bool         `json:"-"`
-		Snippets   interface{}  `json:"-"`
-	}
-
-	messageChat struct {
-		Sender      string      `json:"sender,omitempty"`
-		Name        string      `json:"name,omitempty"`
-		MemberEvent interface{} `json:"-"`
-	}
-
-	chatMemberEvent struct {
-		Ev_type string   `json:"type,omitempty"`
-		Role    string   `json:"role,omitempty"`
-		Members []string `json:"members,omitempty"`
-	}
-
-	icqRequest struct {
-		Method string         `json:"method,omitempty"`
-		ReqId  string         `json:"reqId,omitempty"`
-		Aimsid string         `json:"aimsid,omitempty"`
-		Params *requestParams `json:"params,omitempty"`
-	}
-	requestParams struct {
-		Sn           string `json:"sn,omitempty"`
-		FromMsgId    uint64 `json:"fromMsgId,omitempty"`
-		Count        int    `json:"count,omitempty"`
-		PatchVersion string `json:"patchVersion,omitempty"`
+		account        string
+		aimsid         string
+		apiUrl         string
+		attachmentsDir string
+		client         *http.Client
+		limiter        *rateLimiter
+		capture        apiCapture
+		replay         *apiReplay
 	}
 
 	// POST /rapi (getHistory)
@@ -112,21 +41,22 @@ type (
 	}
 	getHistoryReqParams struct {
 		Sn           string `json:"sn,omitempty"`
-		FromMsgId    uint64 `json:"fromMsgId,omitempty"`
+		FromMsgId    int64  `json:"fromMsgId,omitempty"`
 		Count        int    `json:"count,omitempty"`
 		PatchVersion string `json:"patchVersion,omitempty"`
 	}
 
 	getHistoryRsp struct {
-		Timestamp uint64 `json:"ts,omitempty"`
-		//		Status    interface{}          `json:"-"`
-		Method  string               `json:"method,omitempty"`
-		ReqId   string               `json:"reqId,omitempty"`
-		Results *getHistoryRspResult `json:"results,omitempty"`
+		Timestamp uint64               `json:"ts,omitempty"`
+		Status    *getHistoryRspStatus `json:"status,omitempty"`
+		Method    string               `json:"method,omitempty"`
+		ReqId     string               `json:"reqId,omitempty"`
+		Results   *getHistoryRspResult `json:"results,omitempty"`
 	}
 
 	getHistoryRspStatus struct {
-		Code int `json:"code,omitempty"`
+		Code   int    `json:"code,omitempty"`
+		Reason string `json:"reason,omitempty"`
 	}
 
 	getHistoryRspResult struct {
@@ -136,8 +66,21 @@ type (
 		Yours        *getHistoryRspResultYours     `json:"yours,omitempty"`
 		Unreads      int                           `json:"ureads,omitempty"`
 		UnreadCnt    int                           `json:"unreadCnt,omitempty"`
-		Patch        []interface{}                 `json:"-"`
-		Persons      []interface{}                 `json:"-"`
+		Patch        []*getHistoryRspResultPatch   `json:"patch,omitempty"`
+		Persons      []*getHistoryRspResultPerson  `json:"persons,omitempty"`
+	}
+
+	getHistoryRspResultPatch struct {
+		MsgId uint64 `json:"msgId,omitempty"`
+		Type  string `json:"type,omitempty"`
+	}
+
+	getHistoryRspResultPerson struct {
+		Sn        string `json:"sn,omitempty"`
+		Friendly  string `json:"friendly,omitempty"`
+		FirstName string `json:"firstName,omitempty"`
+		LastName  string `json:"lastName,omitempty"`
+		Nick      string `json:"nick,omitempty"`
 	}
 
 	getHistoryRspResultYours struct {
@@ -147,25 +90,39 @@ type (
 	}
 
 	getHistoryRspResultMessage struct {
-		ReadsCount int                             `json:"-"`
-		MsgId      uint64                          `json:"msgId,omitempty"`
-		Time       int64                           `json:"time,omitempty"`
-		Wid        string                          `json:"wid,omitempty"`
-		Chat       *getHistoryRspResultMessageChat `json:"chat,omitempty"`
-		Text       string                          `json:"text,omitempty"`
-		Outgoing   bool                            `json:"-"`
-		Snippets   interface{}                     `json:"-"`
+		ReadsCount int                                  `json:"-"`
+		MsgId      uint64                               `json:"msgId,omitempty"`
+		Time       int64                                `json:"time,omitempty"`
+		Wid        string                               `json:"wid,omitempty"`
+		Chat       *getHistoryRspResultMessageChat      `json:"chat,omitempty"`
+		Text       string                               `json:"text,omitempty"`
+		Outgoing   bool                                 `json:"-"`
+		Snippets   []*getHistoryRspResultMessageSnippet `json:"snippets,omitempty"`
+	}
+
+	getHistoryRspResultMessageSnippet struct {
+		Type        string `json:"type,omitempty"`
+		Url         string `json:"url,omitempty"`
+		ContentType string `json:"contentType,omitempty"`
+		Title       string `json:"title,omitempty"`
+		Description string `json:"description,omitempty"`
 	}
 
 	getHistoryRspResultMessageChat struct {
-		Sender      string      `json:"sender,omitempty"`
-		Name        string      `json:"name,omitempty"`
-		MemberEvent interface{} `json:"-"`
+		Sender      string                                     `json:"sender,omitempty"`
+		Name        string                                     `json:"name,omitempty"`
+		MemberEvent *getHistoryRspResultMessageChatMemberEvent `json:"memberEvent,omitempty"`
+	}
+
+	getHistoryRspResultMessageChatMemberEvent struct {
+		Type    string   `json:"type,omitempty"`
+		Role    string   `json:"role,omitempty"`
+		Members []string `json:"members,omitempty"`
 	}
 
 	// GET /getBuddyList
 	getBuddyListRsp struct {
-		Response *getBuddyListRspResponse `json:response`
+		Response *getBuddyListRspResponse `json:"response"`
 	}
 	getBuddyListRspResponse struct {
 		StatusCode int                  `json:"statusCode,omitempty"`
@@ -181,6 +138,14 @@ type (
 		Id      int                              `json:"id,omitempty"`
 		Buddies []*getBuddyListRspDataGroupBuddy `json:"buddies,omitempty"`
 	}
+	// buddyChat is a chat of the buddy list with all groups listing it; Groups are empty for chats
+	// given by aimId only
+	buddyChat struct {
+		AimId, Name string
+		Groups      []string
+		UserType    string
+		Account     string
+	}
 	getBuddyListRspDataGroupBuddy struct {
 		AimId     string `json:"aimId,omitempty"`
 		DisplayId string `json:"displayId,omitempty"`
@@ -189,250 +154,291 @@ type (
 	}
 )
 
-func NewICQApi(aimsid string) (icqApi *ICQApi) {
+func NewICQApi(account, aimsid, apiUrl, attachmentsDir string, rateLimit int) (icqApi *ICQApi) {
 	return &ICQApi{
-		aimsid: aimsid,
+		account:        account,
+		aimsid:         aimsid,
+		apiUrl:         strings.TrimRight(apiUrl, "/"),
+		attachmentsDir: attachmentsDir,
+		limiter:        newRateLimiter(rateLimit),
 		client: &http.Client{
 			Timeout: 3 * time.Second,
 		},
 	}
 }
 
-func (m *ICQApi) dumpHistroyFromChat(chatId string) (e error) {
-	var lastMsgId uint64 = 1
-
-	gLogger.Debug().Msg("Start dumpHistroy loop")
-	for e == nil {
-		lastMsgId, e = m.dumpPartialHistroy(chatId, lastMsgId)
-	}
-
-	return e
-}
-
-func (m *ICQApi) dumpPartialHistroy(chatId string, fromMsgId uint64) (lastMsgId uint64, e error) {
-
-	gLogger.Debug().Str("chatId", chatId).Uint64("fromMsgId", fromMsgId).Msg("Start ICQ API reqeust builder")
-
-	var reqUrl *url.URL
-	if reqUrl, e = url.Parse("https://botapi.icq.net/rapi"); e != nil {
-		return 0, e
-	}
-
-	var buf = new(bytes.Buffer)
-
-	var reqId = uuid.NewV4()
-
-	var reqBodyParams = &requestParams{
-		chatId, fromMsgId, 10, "init",
-	}
-	var reqBody = &icqRequest{
-		"getHistory", reqId.String(), m.aimsid,
-		reqBodyParams,
-	}
-
-	if e = json.NewEncoder(buf).Encode(reqBody); e != nil {
-		return 0, e
-	}
-
-	var req *http.Request
-	if req, e = http.NewRequest("POST", reqUrl.String(), buf); e != nil {
-		return 0, e
-	}
-
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Ubuntu Chromium/62.0.3202.89 Chrome/62.0.3202.89 Safari/537.36")
-	req.Header.Set("Origin", "https://botapi.icq.net/rapi")
-	req.Header.Add("X-Requested-With", "XMLHttpRequest")
-
-	var rsp *http.Response
-	if rsp, e = m.client.Do(req); e != nil {
-		return 0, e
-	}
-	defer rsp.Body.Close()
-
-	return m.parseApiResponse(&rsp.Body)
-}
-
-func (m *ICQApi) parseApiResponse(r *io.ReadCloser) (lastMsgId uint64, e error) {
-
-	var data []byte
-	if data, e = ioutil.ReadAll(*r); e != nil {
-		return 0, e
-	}
-
-	var apiResponse = new(icqApiResponse)
-	if e = json.Unmarshal(data, apiResponse); e != nil {
-		return 0, e
-	}
-
-	m.apiResultDebug(apiResponse)
-	return m.getLastMessageFromResponse(apiResponse.Results.Messages), e
-}
-
-func (m *ICQApi) getLastMessageFromResponse(messages []*resultMessage) (lastMsgId uint64) {
-	lastMsgId = messages[len(messages)-1].MsgId
-	return lastMsgId
-}
-
-func (m *ICQApi) apiResultDebug(res *icqApiResponse) {
-	for i := 0; i < len(res.Results.Messages); i++ {
-		gLogger.Info().Str("author", res.Results.Messages[i].Chat.Sender).Str("msg", res.Results.Messages[i].Text).Uint64("mid", res.Results.Messages[i].MsgId).Msg("message parsed")
-	}
-}
-
-func (m *ICQApi) getChats() (chats []string, e error) {
+func (m *ICQApi) getChats(ctx context.Context) (chats []*buddyChat, e error) {
 
 	gLogger.Debug().Msg("Trying to fetch chats...")
 
 	var reqId = uuid.NewV4()
 
 	var reqUrl *url.URL
-	if reqUrl, e = url.Parse("https://botapi.icq.net/getBuddyList?aimsid=" + m.aimsid + "&r=" + reqId.String()); e != nil {
+	if reqUrl, e = url.Parse(m.apiUrl + "/getBuddyList?aimsid=" + m.aimsid + "&r=" + reqId.String()); e != nil {
 		return nil, e
 	}
 
 	var req *http.Request
-	if req, e = http.NewRequest("GET", reqUrl.String(), nil); e != nil {
+	if req, e = http.NewRequestWithContext(ctx, "GET", reqUrl.String(), nil); e != nil {
 		return nil, e
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Ubuntu Chromium/62.0.3202.89 Chrome/62.0.3202.89 Safari/537.36")
-	req.Header.Set("Origin", "https://botapi.icq.net/getBuddyList")
+	req.Header.Set("Origin", m.apiUrl+"/getBuddyList")
 	req.Header.Add("X-Requested-With", "XMLHttpRequest")
 
 	var rsp *http.Response
-	if rsp, e = m.client.Do(req); e != nil {
+	if rsp, e = m.do(req, &mongodb.CollectionRAPIRequests{
+		Method: "getBuddyList", ReqId: reqId.String(), Account: m.account,
+	}); e != nil {
 		return nil, e
 	}
 	defer rsp.Body.Close()
 
+	if e = newAPIError("getBuddyList", m.account, rsp.StatusCode, rsp.Status); e != nil {
+		return nil, e
+	}
+
 	gLogger.Info().Str("response code", rsp.Status).Msg("ICQ api request has been successful")
 	return m.getChatsResponse(&rsp.Body)
 }
 
-func (m *ICQApi) getChatsResponse(r *io.ReadCloser) (chats []string, e error) {
+func (m *ICQApi) getChatsResponse(r *io.ReadCloser) (chats []*buddyChat, e error) {
 	var data []byte
 	if data, e = ioutil.ReadAll(*r); e != nil {
 		return nil, e
 	}
 
-	fmt.Println(string(data))
+	gLogger.Debug().Bytes("response", data).Msg("ICQ api getBuddyList response")
 
 	var chatsResponse = new(getBuddyListRsp)
 	if e = json.Unmarshal(data, &chatsResponse); e != nil {
 		return nil, e
 	}
 
+	if chatsResponse != nil && chatsResponse.Response != nil {
+		var status = chatsResponse.Response
+		if e = newAPIError("getBuddyList", m.account, status.StatusCode, status.StatusText); e != nil {
+			return nil, e
+		}
+	}
+
+	if e = chatsResponse.validate(); e != nil {
+		return nil, e
+	}
+
 	gLogger.Info().Msg("ICQ api request has been successfully parsed")
 	return m.parseChatResponse(chatsResponse)
 }
 
-func (m *ICQApi) parseChatResponse(chatResponse *getBuddyListRsp) (chats []string, e error) {
-
-	var chatsCollections []interface{}
-	fmt.Println(chatResponse.Response.StatusCode)
+// parseChatResponse expects the validated response
+func (m *ICQApi) parseChatResponse(chatResponse *getBuddyListRsp) (chats []*buddyChat, e error) {
+	var listed = make(map[string]*buddyChat)
 	for _, v := range chatResponse.Response.Data.Groups {
-		gLogger.Debug().Str("group name", v.Name).Msg("")
+		gLogger.Debug().Str("group name", v.Name).Int("chats", len(v.Buddies)).Msg("")
 		for _, v2 := range v.Buddies {
-			chats = append(chats, v2.AimId)
-
-			chatsCollections = append(chatsCollections, mongodb.CollectionChats{
-				ID:    primitive.NewObjectID(),
-				Name:  v2.Friendly,
-				AimId: v2.AimId,
-			})
+			if chat, ok := listed[v2.AimId]; ok {
+				chat.Groups = append(chat.Groups, v.Name)
+				continue
+			}
+
+			listed[v2.AimId] = &buddyChat{
+				AimId:    v2.AimId,
+				Name:     v2.Friendly,
+				Groups:   []string{v.Name},
+				UserType: v2.UserType,
+				Account:  m.account,
+			}
+			chats = append(chats, listed[v2.AimId])
 		}
 	}
 
-	gLogger.Debug().Int("interface length", len(chatsCollections)).Msg("")
-	gLogger.Debug().Int("interface capacity", cap(chatsCollections)).Msg("")
+	return chats, e
+}
+
+// saveChats upserts chat documents of the selected chats by aimId, stored messages are kept
+func saveChats(ctx context.Context, chats []*buddyChat) (e error) {
+	var models = chatModels(chats)
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, e = gMongoDB.BulkWrite(ctx, "chats", models, options.BulkWrite().SetOrdered(false))
+	return e
+}
+
+// chatModels upsert a document for every selected chat, so messages of chats given by aimId only
+// have a document to be pushed to; a chat found in buddy lists of several accounts gets one document
+// tagged with all of them, chats duplicated by earlier runs are updated together
+func chatModels(chats []*buddyChat) (models []mongo.WriteModel) {
+	var merged = make(map[string]*buddyChat)
+	var accounts, groups = make(map[string][]string), make(map[string][]string)
+
+	var aimIds []string
 	for _, v := range chats {
-		gLogger.Debug().Str("chatId from array", v).Msg("")
+		if prev, ok := merged[v.AimId]; !ok {
+			aimIds = append(aimIds, v.AimId)
+			merged[v.AimId] = v
+		} else if len(prev.Groups) == 0 {
+			merged[v.AimId] = v
+		}
+
+		if v.Account != "" {
+			accounts[v.AimId] = append(accounts[v.AimId], v.Account)
+		}
+
+		for _, group := range v.Groups {
+			if !containsString(groups[v.AimId], group) {
+				groups[v.AimId] = append(groups[v.AimId], group)
+			}
+		}
 	}
 
-	if e = gMongoDB.InsertMany("chats", &chatsCollections); e != nil {
-		return nil, e
+	for _, aimId := range aimIds {
+		var chat = merged[aimId]
+		var update = bson.M{
+			"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+		}
+
+		// buddy list data is not known for chats given by aimId only, stored data is kept for them
+		if len(chat.Groups) != 0 {
+			update["$set"] = bson.M{
+				"name":     chat.Name,
+				"groups":   groups[aimId],
+				"userType": chat.UserType,
+			}
+		} else {
+			update["$setOnInsert"] = bson.M{"_id": primitive.NewObjectID(), "name": aimId}
+		}
+
+		if len(accounts[aimId]) != 0 {
+			update["$addToSet"] = bson.M{"accounts": bson.M{"$each": accounts[aimId]}}
+		}
+
+		models = append(models, mongo.NewUpdateManyModel().
+			SetFilter(bson.M{"aimId": aimId}).
+			SetUpdate(update).
+			SetUpsert(true))
 	}
 
-	return chats, e
+	return models
 }
 
-func (m *ICQApi) getChatsMessages(chatIds []string) (e error) {
+func (m *ICQApi) getChatsMessages(ctx context.Context, chatIds []string) (e error) {
 	for _, v := range chatIds {
 		gLogger.Debug().Str("chatid", v).Msg("Add chat parsing to queue")
-		gChatsQueue <- &job{
-			action:  jobActCustomFunc,
-			payload: []interface{}{m, v},
-			payloadFunc: func(args []interface{}) error {
-				var icqApi = args[0].(*ICQApi)
-				var chatId = args[1].(string)
-
-				gLogger.Debug().Str("chatid", chatId).Msg("Starting chat parsing for message history")
-				return icqApi.getChatMessages(chatId, 1)
-			},
+		if e = m.dumpChat(ctx, v); e != nil {
+			return e
 		}
 	}
 
 	return
 }
 
-func (m *ICQApi) getChatMessages(chatId string, fromMsgId uint64) (e error) {
+// dumpChat queues the first history page of the chat; every fetched page queues the next one
+func (m *ICQApi) dumpChat(ctx context.Context, chatId string) (e error) {
+	atomic.AddInt64(&gProgress.chatsQueued, 1)
+
+	var chat = chatRef{m.account, chatId}
 
-	gLogger.Debug().Str("chatId", chatId).Uint64("lastMsgId", fromMsgId).Msg("Trying to fetch messages for chat")
+	// tail dumps page from the newest message and do not use stored checkpoints
+	if gWindow.backward {
+		gCheckpoints.tail(chat)
+		return gChatsQueue.push(ctx, newFetchChatTailJob(m, chatId, gWindow.last))
+	}
+
+	var fromMsgId uint64
+	if fromMsgId, e = gCheckpoints.load(ctx, chat); e != nil {
+		return e
+	}
+
+	var resumed bool
+	if resumed, e = gChatsQueue.resumes(ctx, jobTypeFetchChatPage, chatId); e != nil {
+		return e
+	} else if resumed {
+		gLogger.Info().Str("chatId", chat.String()).Msg("Chat dump has been resumed from the persistent queue")
+		return nil
+	}
+
+	return gChatsQueue.push(ctx, newFetchChatPageJob(m, chatId, fromMsgId))
+}
+
+// getChatMessages requests count messages after fromMsgId; negative count requests
+// messages before fromMsgId and fromMsgId -1 stands for the newest message
+func (m *ICQApi) getChatMessages(ctx context.Context, chatId string, fromMsgId int64, count int) (results *getHistoryRspResult, e error) {
+
+	gLogger.Debug().Str("chatId", chatId).Int64("lastMsgId", fromMsgId).Int("count", count).Msg("Trying to fetch messages for chat")
 
 	var reqId = uuid.NewV4()
 
 	var reqUrl *url.URL
-	if reqUrl, e = url.Parse("https://botapi.icq.net/rapi"); e != nil {
-		return e
+	if reqUrl, e = url.Parse(m.apiUrl + "/rapi"); e != nil {
+		return nil, e
 	}
 
 	var buf = new(bytes.Buffer)
 	if e = json.NewEncoder(buf).Encode(&getHistoryReq{
 		"getHistory", reqId.String(), m.aimsid, &getHistoryReqParams{
-			chatId, fromMsgId, 100, "init",
+			chatId, fromMsgId, count, "init",
 		},
 	}); e != nil {
-		return e
+		return nil, e
 	}
 
 	var req *http.Request
-	if req, e = http.NewRequest("POST", reqUrl.String(), buf); e != nil {
-		return e
+	if req, e = http.NewRequestWithContext(ctx, "POST", reqUrl.String(), buf); e != nil {
+		return nil, e
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Ubuntu Chromium/62.0.3202.89 Chrome/62.0.3202.89 Safari/537.36")
-	req.Header.Set("Origin", "https://botapi.icq.net/rapi")
+	req.Header.Set("Origin", m.apiUrl+"/rapi")
 	req.Header.Add("X-Requested-With", "XMLHttpRequest")
 
 	var rsp *http.Response
-	if rsp, e = m.client.Do(req); e != nil {
-		return e
+	if rsp, e = m.do(req, &mongodb.CollectionRAPIRequests{
+		Method: "getHistory", ReqId: reqId.String(), Account: m.account,
+		Params: &mongodb.CollectionRAPIRequestsParams{
+			Sn: chatId, FromMsgId: fromMsgId, Count: count, PatchVersion: "init",
+		},
+	}); e != nil {
+		return nil, e
 	}
 	defer rsp.Body.Close()
 
-	if rsp.StatusCode != 200 {
-		return errors.New("ICQ api send non 200 OK")
+	if e = newAPIError("getHistory", m.account, rsp.StatusCode, rsp.Status); e != nil {
+		return nil, e
 	}
 
 	var messagesResponse *getHistoryRsp
 	if messagesResponse, e = m.getChatMessagesResponse(&rsp.Body); e != nil {
-		return e
+		return nil, e
 	}
 
-	var lastMsgId uint64
-	if lastMsgId, e = m.parseChatMessagesResponse(chatId, messagesResponse.Results.Messages); e != nil || lastMsgId == 0 {
-		return e
+	return messagesResponse.Results, e
+}
+
+// do waits for the rate limiter, sends the API request and records its status and latency;
+// the request described by record is captured with its response or served from the replay
+func (m *ICQApi) do(req *http.Request, record *mongodb.CollectionRAPIRequests) (rsp *http.Response, e error) {
+	if m.replay != nil {
+		return m.replay.response(req, record)
 	}
 
-	//	recursive calls
-	if e = m.getChatMessages(chatId, lastMsgId); e != nil {
-		return e
+	if e = m.limiter.wait(req.Context()); e != nil {
+		return nil, e
 	}
 
-	return e
+	var started = time.Now()
+	rsp, e = m.client.Do(req)
+	gMetrics.observeAPI(record.Method, started, rsp, e)
+
+	if m.capture != nil {
+		return captureResponse(req.Context(), m.capture, record, started, rsp, e)
+	}
+
+	return rsp, e
 }
 
 func (m *ICQApi) getChatMessagesResponse(r *io.ReadCloser) (messagesResponse *getHistoryRsp, e error) {
@@ -446,39 +452,69 @@ func (m *ICQApi) getChatMessagesResponse(r *io.ReadCloser) (messagesResponse *ge
 		return nil, e
 	}
 
-	return messagesResponse, e
+	if messagesResponse != nil && messagesResponse.Status != nil {
+		if e = newAPIError("getHistory", m.account, messagesResponse.Status.Code, messagesResponse.Status.Reason); e != nil {
+			return nil, e
+		}
+	}
+
+	return messagesResponse, messagesResponse.validate()
+}
+
+func newChatMessage(message *getHistoryRspResultMessage) *mongodb.CollectionChatsMessage {
+	var chatMessage = &mongodb.CollectionChatsMessage{
+		MsgId: message.MsgId,
+		Time:  time.Unix(message.Time, 0),
+		Wid:   message.Wid,
+		Text:  message.Text,
+	}
+
+	if message.Chat != nil {
+		chatMessage.Sender = message.Chat.Sender
+
+		if event := message.Chat.MemberEvent; event != nil {
+			chatMessage.MemberEvent = &mongodb.CollectionChatsMemberEvent{
+				Type:    event.Type,
+				Role:    event.Role,
+				Members: event.Members,
+			}
+		}
+	}
+
+	for _, v := range message.Snippets {
+		if v == nil {
+			continue
+		}
+
+		chatMessage.Snippets = append(chatMessage.Snippets, &mongodb.CollectionChatsSnippet{
+			Type:        v.Type,
+			Url:         v.Url,
+			ContentType: v.ContentType,
+			Title:       v.Title,
+			Description: v.Description,
+		})
+	}
+
+	return chatMessage
+}
+
+func newPerson(person *getHistoryRspResultPerson, updatedAt time.Time) *mongodb.CollectionPersons {
+	return &mongodb.CollectionPersons{
+		Sn:        person.Sn,
+		Friendly:  person.Friendly,
+		FirstName: person.FirstName,
+		LastName:  person.LastName,
+		Nick:      person.Nick,
+		UpdatedAt: updatedAt,
+	}
 }
 
-func (m *ICQApi) parseChatMessagesResponse(chatId string, messages []*getHistoryRspResultMessage) (lastMsgId uint64, e error) {
-
-	// if no messages - exit
-	if len(messages) == 0 {
-		return 0, e
-	}
-
-	lastMsgId = messages[len(messages)-1].MsgId
-	for _, v := range messages {
-		gDBQueue <- &job{
-			action:  jobActCustomFunc,
-			payload: []interface{}{v},
-			payloadFunc: func(args []interface{}) error {
-				var message = args[0].(*getHistoryRspResultMessage)
-				return gMongoDB.UpdateOne("chats", bson.M{
-					"aimId": chatId,
-				}, bson.M{
-					"$push": bson.M{
-						"messages": &mongodb.CollectionChatsMessage{
-							MsgId:  message.MsgId,
-							Time:   time.Unix(message.Time, 0),
-							Wid:    message.Wid,
-							Sender: message.Chat.Sender,
-							Text:   message.Text,
-						},
-					},
-				})
-			},
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
 	}
 
-	return lastMsgId, e
+	return false
 }
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// chats selected by aimId only must get a document, the message writer pushes to existing documents only
+func TestChatModelsUpsertAimIdOnlyChat(t *testing.T) {
+	var models = chatModels([]*buddyChat{
+		{AimId: "100@chat.agent", Account: "work"},
+		{AimId: "200@chat.agent", Name: "Buddy", Groups: []string{"General", "Work"}, Account: "work"},
+		{AimId: "200@chat.agent", Name: "Buddy", Groups: []string{"Work", "Home"}, Account: "home"},
+	})
+
+	if len(models) != 2 {
+		t.Fatalf("got %d models, want 2", len(models))
+	}
+
+	for i, aimId := range []string{"100@chat.agent", "200@chat.agent"} {
+		var model, ok = models[i].(*mongo.UpdateManyModel)
+		if !ok {
+			t.Fatalf("model %d is %T, want *mongo.UpdateManyModel", i, models[i])
+		}
+
+		if model.Upsert == nil || !*model.Upsert {
+			t.Errorf("chat %s is not upserted", aimId)
+		}
+		if filter := model.Filter.(bson.M); filter["aimId"] != aimId {
+			t.Errorf("model %d filters aimId %v, want %s", i, filter["aimId"], aimId)
+		}
+	}
+
+	var aimIdOnly = models[0].(*mongo.UpdateManyModel).Update.(bson.M)
+	if _, ok := aimIdOnly["$set"]; ok {
+		t.Errorf("chat given by aimId only overwrites stored buddy list data: %v", aimIdOnly)
+	}
+
+	var merged = models[1].(*mongo.UpdateManyModel).Update.(bson.M)
+	if set := merged["$set"].(bson.M); len(set["groups"].([]string)) != 3 || set["name"] != "Buddy" {
+		t.Errorf("buddy list data is lost for the chat selected twice: %v", set)
+	}
+	if accounts := merged["$addToSet"].(bson.M)["accounts"].(bson.M)["$each"].([]string); len(accounts) != 2 {
+		t.Errorf("got accounts %v, want both accounts", accounts)
+	}
+}
+
+// bounded dumps start from the window edge, stored checkpoints of previous dumps could be past it;
+// gMongoDB is nil, so loading a stored checkpoint fails the test
+func TestDumpChatBoundedWindowIgnoresCheckpoints(t *testing.T) {
+	var nop = zerolog.Nop()
+	gLogger, gMongoDB, gProgress, gJobMetrics = &nop, nil, newProgress(), newJobMetrics()
+
+	var tests = []struct {
+		name      string
+		window    *historyWindow
+		fromMsgId uint64
+		backward  bool
+	}{
+		{"until only", &historyWindow{until: time.Now().AddDate(0, -1, 0)}, 1, false},
+		{"since", &historyWindow{since: time.Now().AddDate(0, -1, 0), backward: true}, 0, true},
+		{"last", &historyWindow{backward: true, last: 10}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gWindow = tt.window
+			gCheckpoints = newCheckpoints(false, gWindow.bounded())
+			gChatsQueue = newDispatcher("chats", 1, 1)
+
+			if e := (&ICQApi{account: "work"}).dumpChat(context.Background(), "100@chat.agent"); e != nil {
+				t.Fatal(e)
+			}
+
+			var page = (<-gChatsQueue.queue).(*FetchChatPage)
+			if page.FromMsgId != tt.fromMsgId || page.Backward != tt.backward {
+				t.Errorf("got page from msgId %d backward %v, want from msgId %d backward %v",
+					page.FromMsgId, page.Backward, tt.fromMsgId, tt.backward)
+			}
+		})
+	}
+}
+
+// fetch, save and download jobs of one chat share the shard key, and the chat is fetched by one account
+func TestSharedChatIsFetchedOnce(t *testing.T) {
+	var api = &ICQApi{account: "work"}
+	var keys = []string{
+		newFetchChatPageJob(api, "100@chat.agent", 1).Key(),
+		newSaveMessagesJob(api, "100@chat.agent", 1, 2, nil).Key(),
+		newDownloadAttachmentJob(api, "100@chat.agent", 2, "https://files.icq.net/get/1").Key(),
+	}
+	for _, v := range keys {
+		if v != keys[0] {
+			t.Errorf("got job keys %v, want the same key", keys)
+		}
+	}
+
+	var chatIds = fetchedChatIds([][]*buddyChat{
+		{{AimId: "100@chat.agent"}, {AimId: "200@chat.agent"}},
+		{{AimId: "200@chat.agent"}, {AimId: "300@chat.agent"}},
+	})
+
+	if len(chatIds) != 2 || len(chatIds[0]) != 2 || len(chatIds[1]) != 1 || chatIds[1][0] != "300@chat.agent" {
+		t.Errorf("got fetched chats %v, want the shared chat fetched by the first account only", chatIds)
+	}
+}
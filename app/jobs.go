@@ -0,0 +1,430 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	jobTypeFetchChatPage      = "FetchChatPage"
+	jobTypeSaveMessages       = "SaveMessages"
+	jobTypeDownloadAttachment = "DownloadAttachment"
+)
+
+const (
+	historyPageSize       = 100
+	downloadHeaderTimeout = 30 * time.Second
+)
+
+var attachmentUrlRegexp = regexp.MustCompile(`https?://files\.icq\.net/get/[^\s"'<>]+`)
+
+// downloadClient fetches attachments and avatars; it has no total timeout, so large files are
+// bounded only by ctx and by the wait for response headers
+var downloadClient = newDownloadClient()
+
+// jobDecoders restore jobs from the persistent queue payloads
+var jobDecoders = map[string]func(accounts icqAccounts, raw []byte) (Job, error){
+	jobTypeFetchChatPage: func(accounts icqAccounts, raw []byte) (jb Job, e error) {
+		var page = new(FetchChatPage)
+		if e = bson.Unmarshal(raw, &page.fetchChatPagePayload); e != nil {
+			return nil, e
+		}
+		if page.api, e = accounts.get(page.Account); e != nil {
+			return nil, e
+		}
+
+		resumeCheckpoint(page.ref())
+		return page, nil
+	},
+	jobTypeSaveMessages: func(accounts icqAccounts, raw []byte) (jb Job, e error) {
+		var page = new(SaveMessages)
+		if e = bson.Unmarshal(raw, &page.saveMessagesPayload); e != nil {
+			return nil, e
+		}
+		if page.api, e = accounts.get(page.Account); e != nil {
+			return nil, e
+		}
+
+		// resumed pages are chained to the stored checkpoint of the chat
+		resumeCheckpoint(page.ref())
+		gCheckpoints.fetched(page.ref(), page.lastMsgId(), 0)
+		return page, nil
+	},
+	jobTypeDownloadAttachment: func(accounts icqAccounts, raw []byte) (jb Job, e error) {
+		var download = new(DownloadAttachment)
+		if e = bson.Unmarshal(raw, &download.downloadAttachmentPayload); e != nil {
+			return nil, e
+		}
+		if download.api, e = accounts.get(download.Account); e != nil {
+			return nil, e
+		}
+
+		return download, nil
+	},
+}
+
+func resumeCheckpoint(chat chatRef) {
+	if _, e := gCheckpoints.load(context.Background(), chat); e != nil {
+		gLogger.Warn().Err(e).Str("chatId", chat.String()).Msg("Could not load checkpoint of the resumed job")
+	}
+}
+
+type (
+	// FetchChatPage requests one history page of the chat and queues
+	// the page messages for saving and the next page for fetching
+	FetchChatPage struct {
+		jobState
+		fetchChatPagePayload
+		api *ICQApi
+	}
+	// backward pages go from FromMsgId (0 for the newest message) to older messages,
+	// Remaining limits messages count of the backward dump
+	fetchChatPagePayload struct {
+		ChatId    string `bson:"chatId"`
+		Account   string `bson:"account,omitempty"`
+		FromMsgId uint64 `bson:"fromMsgId"`
+		Backward  bool   `bson:"backward,omitempty"`
+		Remaining int    `bson:"remaining,omitempty"`
+	}
+
+	// SaveMessages writes one fetched history page to the chat document;
+	// FromMsgId and LastMsgId link the page to its neighbours for checkpointing,
+	// messages out of the dump window are not in Messages
+	SaveMessages struct {
+		jobState
+		saveMessagesPayload
+		api *ICQApi
+	}
+	saveMessagesPayload struct {
+		ChatId    string                            `bson:"chatId"`
+		Account   string                            `bson:"account,omitempty"`
+		FromMsgId uint64                            `bson:"fromMsgId"`
+		LastMsgId uint64                            `bson:"lastMsgId"`
+		Backward  bool                              `bson:"backward,omitempty"`
+		Messages  []*mongodb.CollectionChatsMessage `bson:"messages"`
+		Persons   []*mongodb.CollectionPersons      `bson:"persons,omitempty"`
+		Patches   []*messagePatch                   `bson:"patches,omitempty"`
+	}
+
+	// DownloadAttachment saves the file linked from a message into the attachments directory
+	DownloadAttachment struct {
+		jobState
+		downloadAttachmentPayload
+		api *ICQApi
+	}
+	downloadAttachmentPayload struct {
+		ChatId  string `bson:"chatId"`
+		Account string `bson:"account,omitempty"`
+		MsgId   uint64 `bson:"msgId"`
+		Url     string `bson:"url"`
+	}
+)
+
+func newFetchChatPageJob(api *ICQApi, chatId string, fromMsgId uint64) *FetchChatPage {
+	return &FetchChatPage{
+		jobState:             newJobState(),
+		fetchChatPagePayload: fetchChatPagePayload{ChatId: chatId, Account: api.account, FromMsgId: fromMsgId},
+		api:                  api,
+	}
+}
+
+// newFetchChatTailJob requests the newest page of the chat; last limits messages count if it is not 0
+func newFetchChatTailJob(api *ICQApi, chatId string, last int) *FetchChatPage {
+	return &FetchChatPage{
+		jobState:             newJobState(),
+		fetchChatPagePayload: fetchChatPagePayload{ChatId: chatId, Account: api.account, Backward: true, Remaining: last},
+		api:                  api,
+	}
+}
+
+func newSaveMessagesJob(api *ICQApi, chatId string, fromMsgId, lastMsgId uint64, messages []*mongodb.CollectionChatsMessage) *SaveMessages {
+	var payload = saveMessagesPayload{
+		ChatId: chatId, Account: api.account, FromMsgId: fromMsgId, LastMsgId: lastMsgId, Messages: messages,
+	}
+
+	return &SaveMessages{
+		jobState:            newJobState(),
+		saveMessagesPayload: payload,
+		api:                 api,
+	}
+}
+
+func newDownloadAttachmentJob(api *ICQApi, chatId string, msgId uint64, url string) *DownloadAttachment {
+	return &DownloadAttachment{
+		jobState:                  newJobState(),
+		downloadAttachmentPayload: downloadAttachmentPayload{chatId, api.account, msgId, url},
+		api:                       api,
+	}
+}
+
+func (m *FetchChatPage) Type() string         { return jobTypeFetchChatPage }
+func (m *FetchChatPage) Key() string          { return m.ChatId }
+func (m *FetchChatPage) payload() interface{} { return &m.fetchChatPagePayload }
+func (m *FetchChatPage) String() string {
+	if m.Backward {
+		return fmt.Sprintf("chat %s backward from msgId %d", m.ref(), m.FromMsgId)
+	}
+
+	return fmt.Sprintf("chat %s from msgId %d", m.ref(), m.FromMsgId)
+}
+
+func (m *FetchChatPage) ref() chatRef { return chatRef{m.Account, m.ChatId} }
+
+// request returns getHistory fromMsgId and count of the page
+func (m *FetchChatPage) request() (fromMsgId int64, count int) {
+	if !m.Backward {
+		return int64(m.FromMsgId), historyPageSize
+	}
+
+	fromMsgId, count = int64(m.FromMsgId), -historyPageSize
+	if m.FromMsgId == 0 {
+		fromMsgId = -1
+	}
+	if m.Remaining > 0 && m.Remaining < historyPageSize {
+		count = -m.Remaining
+	}
+
+	return fromMsgId, count
+}
+
+// boundary sorts page messages by msgId and returns msgId the next page is requested from
+func (m *FetchChatPage) boundary(messages []*getHistoryRspResultMessage) (filtered []*getHistoryRspResultMessage, msgId uint64) {
+	sort.Slice(messages, func(i, j int) bool { return messages[i].MsgId < messages[j].MsgId })
+
+	if !m.Backward {
+		return messages, messages[len(messages)-1].MsgId
+	}
+
+	// the boundary message could be returned again by the backward request
+	for _, v := range messages {
+		if m.FromMsgId == 0 || v.MsgId < m.FromMsgId {
+			filtered = append(filtered, v)
+		}
+	}
+
+	if len(filtered) == 0 {
+		return filtered, 0
+	}
+
+	return filtered, filtered[0].MsgId
+}
+
+func (m *FetchChatPage) Run(ctx context.Context) (e error) {
+	if e = gWriter.throttle(ctx); e != nil {
+		return e
+	}
+
+	ctx = gChatSpans.context(ctx, m.ref(), m.FromMsgId)
+	var pageCtx, span = startSpan(ctx, "getHistory",
+		attribute.String("aimId", m.ChatId), attribute.String("account", m.Account), attribute.Int64("fromMsgId", int64(m.FromMsgId)))
+
+	var fromMsgId, count = m.request()
+
+	var results *getHistoryRspResult
+	results, e = m.api.getChatMessages(pageCtx, m.ChatId, fromMsgId, count)
+
+	var messages []*getHistoryRspResultMessage
+	if results != nil {
+		messages = results.Messages
+	}
+	span.SetAttributes(attribute.Int("messages", len(messages)), attribute.Bool("backward", m.Backward))
+	if endSpan(span, e); e != nil {
+		return e
+	}
+
+	var lastMsgId uint64
+	if len(messages) != 0 {
+		messages, lastMsgId = m.boundary(messages)
+	}
+
+	// if no messages - chat history is over
+	if len(messages) == 0 {
+		gCheckpoints.complete(m.ref())
+		atomic.AddInt64(&gProgress.chatsDone, 1)
+		return nil
+	}
+
+	atomic.AddInt64(&gProgress.pagesFetched, 1)
+	atomic.AddInt64(&gProgress.messagesFetched, int64(len(messages)))
+	gMetrics.observePage(m.ChatId, len(messages))
+	gCheckpoints.fetched(m.ref(), lastMsgId, len(messages))
+
+	var windowDone bool
+	messages, windowDone = gWindow.filter(messages, m.Backward)
+
+	var remaining = m.Remaining
+	if remaining > 0 {
+		if len(messages) >= remaining {
+			messages, windowDone = messages[len(messages)-remaining:], true
+		}
+		remaining -= len(messages)
+	}
+
+	var persons, patches = newPersons(results.Persons, time.Now()), newPatches(results.Patch)
+
+	if len(messages) == 0 && len(persons) == 0 && len(patches) == 0 {
+		// the empty page without messages of the window is linked to the checkpoint chain here
+		gCheckpoints.saved(m.ref(), m.FromMsgId, lastMsgId, 0)
+	} else {
+		var chatMessages = make([]*mongodb.CollectionChatsMessage, 0, len(messages))
+		for _, v := range messages {
+			var message = newChatMessage(v)
+			message.Account = m.Account
+			chatMessages = append(chatMessages, message)
+		}
+
+		// persons and patches are saved with the messages of the page, patches of stored messages
+		// are saved even if the page has no messages of the window
+		var jb = newSaveMessagesJob(m.api, m.ChatId, m.FromMsgId, lastMsgId, chatMessages)
+		jb.Backward, jb.Persons, jb.Patches = m.Backward, persons, patches
+		if e = gDBQueue.push(ctx, jb); e != nil {
+			return e
+		}
+	}
+
+	if m.api.attachmentsDir != "" {
+		for _, v := range messages {
+			for _, link := range attachmentUrlRegexp.FindAllString(v.Text, -1) {
+				if e = gChatsQueue.push(ctx, newDownloadAttachmentJob(m.api, m.ChatId, v.MsgId, link)); e != nil {
+					return e
+				}
+			}
+		}
+	}
+
+	if windowDone {
+		gLogger.Info().Str("chatId", m.ref().String()).Msg("Chat history has reached the dump window bound")
+		gCheckpoints.complete(m.ref())
+		atomic.AddInt64(&gProgress.chatsDone, 1)
+		return nil
+	}
+
+	var next = newFetchChatPageJob(m.api, m.ChatId, lastMsgId)
+	next.Backward, next.Remaining = m.Backward, remaining
+	return gChatsQueue.push(ctx, next)
+}
+
+func (m *SaveMessages) Type() string         { return jobTypeSaveMessages }
+func (m *SaveMessages) Key() string          { return m.ChatId }
+func (m *SaveMessages) payload() interface{} { return &m.saveMessagesPayload }
+func (m *SaveMessages) String() string {
+	if len(m.Messages) == 0 {
+		return fmt.Sprintf("chat %s, %d patches of the page from msgId %d", m.ref(), len(m.Patches), m.FromMsgId)
+	}
+
+	return fmt.Sprintf("chat %s, %d messages from msgId %d", m.ref(), len(m.Messages), m.Messages[0].MsgId)
+}
+
+func (m *SaveMessages) ref() chatRef { return chatRef{m.Account, m.ChatId} }
+
+func (m *SaveMessages) size() int { return len(m.Messages) }
+
+func (m *SaveMessages) lastMsgId() uint64 {
+	if m.LastMsgId == 0 && len(m.Messages) != 0 {
+		return m.Messages[len(m.Messages)-1].MsgId
+	}
+
+	return m.LastMsgId
+}
+
+// Run is safe to retry, already saved messages are skipped by msgId
+func (m *SaveMessages) Run(ctx context.Context) (e error) {
+	return gWriter.write(ctx, []*SaveMessages{m})
+}
+
+func (m *SaveMessages) runBatch(ctx context.Context, jobs []Job) (e error) {
+	var pages = make([]*SaveMessages, 0, len(jobs))
+	for _, v := range jobs {
+		pages = append(pages, v.(*SaveMessages))
+	}
+
+	return gWriter.write(ctx, pages)
+}
+
+func (m *DownloadAttachment) Type() string         { return jobTypeDownloadAttachment }
+func (m *DownloadAttachment) Key() string          { return m.ChatId }
+func (m *DownloadAttachment) payload() interface{} { return &m.downloadAttachmentPayload }
+func (m *DownloadAttachment) String() string {
+	return fmt.Sprintf("chat %s, msgId %d, url %s", m.ChatId, m.MsgId, m.Url)
+}
+
+func newDownloadClient() *http.Client {
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = downloadHeaderTimeout
+
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
+// saveDownload streams body to a temp file of dir renamed to name when it is complete,
+// so interrupted downloads never leave partial files
+func saveDownload(dir, name string, body io.Reader) (file string, e error) {
+	var fd *os.File
+	if fd, e = os.CreateTemp(dir, "."+name+".*"); e != nil {
+		return "", e
+	}
+	defer func() {
+		if e != nil {
+			fd.Close()
+			os.Remove(fd.Name())
+		}
+	}()
+
+	if _, e = io.Copy(fd, body); e != nil {
+		return "", e
+	}
+	if e = fd.Sync(); e != nil {
+		return "", e
+	}
+	if e = fd.Close(); e != nil {
+		return "", e
+	}
+
+	file = filepath.Join(dir, name)
+	return file, os.Rename(fd.Name(), file)
+}
+
+func (m *DownloadAttachment) Run(ctx context.Context) (e error) {
+	var link *url.URL
+	if link, e = url.Parse(m.Url); e != nil {
+		return e
+	}
+
+	var dir = filepath.Join(m.api.attachmentsDir, safeFileName(m.ChatId))
+	if e = os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+
+	var req *http.Request
+	if req, e = http.NewRequestWithContext(ctx, "GET", link.String(), nil); e != nil {
+		return e
+	}
+
+	var rsp *http.Response
+	if rsp, e = downloadClient.Do(req); e != nil {
+		return e
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != 200 {
+		return fmt.Errorf("attachment server responded with %s", rsp.Status)
+	}
+
+	_, e = saveDownload(dir, fmt.Sprintf("%d-%s", m.MsgId, path.Base(link.Path)), rsp.Body)
+	return e
+}
@@ -0,0 +1,393 @@
+package app
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	loginClientName    = "icqdumper"
+	loginClientVersion = "0.1"
+
+	// sessions are requested for 30 days and restarted an hour before they expire
+	loginSessionTimeout = 30 * 24 * time.Hour
+	loginSessionMargin  = time.Hour
+)
+
+type (
+	// LoginParams are given to the login command: Uin and Password for the password login or
+	// Phone for the SMS code login; Name stores the session as the named account
+	LoginParams struct {
+		Name            string
+		Uin, Password   string
+		Phone           string
+		AuthURL, SMSURL string
+		DevId           string
+		Credentials     string
+	}
+
+	// credential is the stored session of one account: the long-term token and the session key
+	// restart the aimsid session without the password
+	credential struct {
+		Login          string    `json:"login"`
+		Token          string    `json:"token"`
+		TokenExpires   time.Time `json:"tokenExpires,omitempty"`
+		SessionKey     string    `json:"sessionKey"`
+		TimeOffset     int64     `json:"timeOffset"`
+		AimSid         string    `json:"aimsid"`
+		SessionExpires time.Time `json:"sessionExpires"`
+		UpdatedAt      time.Time `json:"updatedAt"`
+	}
+	// credentials are stored by account name, the default account has the empty name
+	credentials map[string]*credential
+
+	authClient struct {
+		authUrl, smsUrl, devId string
+		client                 *http.Client
+	}
+
+	wimResponse struct {
+		Response *struct {
+			StatusCode int             `json:"statusCode"`
+			StatusText string          `json:"statusText"`
+			Data       json.RawMessage `json:"data"`
+		} `json:"response"`
+	}
+	wimClientLoginData struct {
+		Token *struct {
+			A         string `json:"a"`
+			ExpiresIn int64  `json:"expiresIn"`
+		} `json:"token"`
+		SessionSecret string `json:"sessionSecret"`
+		HostTime      int64  `json:"hostTime"`
+		SessionKey    string `json:"sessionKey"`
+	}
+	wimPhoneValidationData struct {
+		TransId string `json:"trans_id"`
+	}
+	wimStartSessionData struct {
+		AimSid string `json:"aimsid"`
+	}
+)
+
+func newAuthClient(authUrl, smsUrl, devId string) *authClient {
+	return &authClient{
+		authUrl: strings.TrimRight(authUrl, "/"),
+		smsUrl:  strings.TrimRight(smsUrl, "/"),
+		devId:   devId,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Login authenticates the account, starts the aimsid session and stores it in the credentials file;
+// the SMS code of the phone login is read from in
+func (m *App) Login(in io.Reader, out io.Writer, params *LoginParams) (e error) {
+	var auth = newAuthClient(params.AuthURL, params.SMSURL, params.DevId)
+
+	var cred *credential
+	if len(params.Phone) != 0 {
+		cred, e = auth.phoneLogin(in, out, params.Phone)
+	} else {
+		cred, e = auth.passwordLogin(params.Uin, params.Password)
+	}
+	if e != nil {
+		return e
+	}
+
+	if e = auth.startSession(cred); e != nil {
+		return e
+	}
+
+	var stored credentials
+	if stored, e = loadCredentials(params.Credentials); e != nil {
+		return e
+	}
+	stored[params.Name] = cred
+
+	if e = stored.save(params.Credentials); e != nil {
+		return e
+	}
+
+	gLogger.Info().Str("login", cred.Login).Str("account", params.Name).Str("credentials", params.Credentials).
+		Msg("Session has been successfully stored")
+	return e
+}
+
+// SessionAccounts returns accounts of stored sessions; names select stored accounts, all of them are
+// returned if names are empty; expired sessions are restarted and saved back to the credentials file
+func SessionAccounts(path, authUrl, devId string, names ...string) (accounts []*Account, e error) {
+	var stored credentials
+	if stored, e = loadCredentials(path); e != nil {
+		return nil, e
+	}
+
+	if len(names) == 0 {
+		for name := range stored {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var auth, refreshed = newAuthClient(authUrl, "", devId), false
+	for _, name := range names {
+		var cred, ok = stored[name]
+		if !ok {
+			return nil, errors.New("Account " + name + " is not found in " + path + "! Run the login command first")
+		}
+
+		if time.Now().Add(loginSessionMargin).After(cred.SessionExpires) {
+			if !cred.TokenExpires.IsZero() && time.Now().After(cred.TokenExpires) {
+				return nil, errors.New("Login token of account " + cred.Login + " has expired! Run the login command again")
+			}
+
+			if e = auth.startSession(cred); e != nil {
+				return nil, errors.New("Could not restart session of account " + cred.Login + "! " + e.Error())
+			}
+			refreshed = true
+		}
+
+		accounts = append(accounts, &Account{Name: name, AimSid: cred.AimSid})
+	}
+
+	if refreshed {
+		e = stored.save(path)
+	}
+
+	return accounts, e
+}
+
+func loadCredentials(path string) (stored credentials, e error) {
+	stored = make(credentials)
+
+	var data []byte
+	if data, e = os.ReadFile(path); os.IsNotExist(e) {
+		return stored, nil
+	} else if e != nil {
+		return nil, e
+	}
+
+	if e = json.Unmarshal(data, &stored); e != nil {
+		return nil, errors.New("Could not parse credentials file " + path + "! " + e.Error())
+	}
+
+	return stored, e
+}
+
+// save replaces the credentials file, it is readable by the owner only
+func (m credentials) save(path string) (e error) {
+	if e = os.MkdirAll(filepath.Dir(path), 0700); e != nil {
+		return e
+	}
+
+	var data []byte
+	if data, e = json.MarshalIndent(m, "", "  "); e != nil {
+		return e
+	}
+
+	var fd *os.File
+	if fd, e = os.CreateTemp(filepath.Dir(path), ".credentials-*"); e != nil {
+		return e
+	}
+	defer os.Remove(fd.Name())
+
+	if _, e = fd.Write(data); e != nil {
+		fd.Close()
+		return e
+	}
+	if e = fd.Close(); e != nil {
+		return e
+	}
+
+	if e = os.Chmod(fd.Name(), 0600); e != nil {
+		return e
+	}
+
+	return os.Rename(fd.Name(), path)
+}
+
+func (m *authClient) passwordLogin(uin, password string) (cred *credential, e error) {
+	if len(uin) == 0 || len(password) == 0 {
+		return nil, errors.New("UIN and password are required for the password login!")
+	}
+
+	var data = new(wimClientLoginData)
+	if e = m.call("POST", m.authUrl+"/auth/clientLogin", url.Values{
+		"clientName":    {loginClientName},
+		"clientVersion": {loginClientVersion},
+		"devId":         {m.devId},
+		"f":             {"json"},
+		"idType":        {"ICQ"},
+		"pwd":           {password},
+		"s":             {uin},
+		"tokenType":     {"longterm"},
+	}, data); e != nil {
+		return nil, e
+	}
+
+	if len(data.SessionSecret) == 0 {
+		return nil, newValidationError("clientLogin", "sessionSecret", "is missing")
+	}
+
+	return newCredential(uin, data, signature(password, data.SessionSecret)), nil
+}
+
+func (m *authClient) phoneLogin(in io.Reader, out io.Writer, phone string) (cred *credential, e error) {
+	var validation = new(wimPhoneValidationData)
+	if e = m.call("GET", m.smsUrl+"/requestPhoneValidation.php", url.Values{
+		"k":             {m.devId},
+		"locale":        {"en"},
+		"msisdn":        {phone},
+		"r":             {uuid.NewV4().String()},
+		"smsFormatType": {"human"},
+	}, validation); e != nil {
+		return nil, e
+	}
+
+	fmt.Fprintf(out, "SMS code sent to %s: ", phone)
+
+	var code string
+	if code, e = bufio.NewReader(in).ReadString('\n'); e != nil && e != io.EOF {
+		return nil, e
+	}
+	if code = strings.TrimSpace(code); len(code) == 0 {
+		return nil, errors.New("SMS code is empty!")
+	}
+
+	var data = new(wimClientLoginData)
+	if e = m.call("GET", m.smsUrl+"/loginWithPhoneNumber.php", url.Values{
+		"f":        {"json"},
+		"k":        {m.devId},
+		"msisdn":   {phone},
+		"r":        {uuid.NewV4().String()},
+		"sms_code": {code},
+		"trans_id": {validation.TransId},
+	}, data); e != nil {
+		return nil, e
+	}
+
+	if len(data.SessionKey) == 0 {
+		return nil, newValidationError("loginWithPhoneNumber", "sessionKey", "is missing")
+	}
+
+	return newCredential(phone, data, data.SessionKey), nil
+}
+
+func newCredential(login string, data *wimClientLoginData, sessionKey string) *credential {
+	var cred = &credential{
+		Login:      login,
+		Token:      data.Token.A,
+		SessionKey: sessionKey,
+	}
+
+	if data.HostTime != 0 {
+		cred.TimeOffset = data.HostTime - time.Now().Unix()
+	}
+	if data.Token.ExpiresIn != 0 {
+		cred.TokenExpires = time.Now().Add(time.Duration(data.Token.ExpiresIn) * time.Second)
+	}
+
+	return cred
+}
+
+// startSession requests the new aimsid with the signed token of the credential
+func (m *authClient) startSession(cred *credential) (e error) {
+	var reqUrl = m.authUrl + "/aim/startSession"
+	var params = url.Values{
+		"a":              {cred.Token},
+		"clientName":     {loginClientName},
+		"clientVersion":  {loginClientVersion},
+		"events":         {"myInfo,buddylist,hist,mchat"},
+		"f":              {"json"},
+		"imf":            {"plain"},
+		"k":              {m.devId},
+		"language":       {"en-us"},
+		"sessionTimeout": {strconv.FormatInt(int64(loginSessionTimeout/time.Second), 10)},
+		"ts":             {strconv.FormatInt(time.Now().Unix()+cred.TimeOffset, 10)},
+		"view":           {"online"},
+	}
+	params.Set("sig_sha256", signature(cred.SessionKey, "POST&"+wimEscape(reqUrl)+"&"+wimEscape(wimEncode(params))))
+
+	var data = new(wimStartSessionData)
+	if e = m.call("POST", reqUrl, params, data); e != nil {
+		return e
+	}
+
+	var now = time.Now()
+	cred.AimSid, cred.SessionExpires, cred.UpdatedAt = data.AimSid, now.Add(loginSessionTimeout), now
+	return e
+}
+
+// call sends the form request, decodes data of the successful WIM response into v and validates it
+func (m *authClient) call(method, reqUrl string, params url.Values, v interface{}) (e error) {
+	var req *http.Request
+	if method == "GET" {
+		req, e = http.NewRequest(method, reqUrl+"?"+wimEncode(params), nil)
+	} else {
+		req, e = http.NewRequest(method, reqUrl, strings.NewReader(wimEncode(params)))
+	}
+	if e != nil {
+		return e
+	}
+
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	var rsp *http.Response
+	if rsp, e = m.client.Do(req); e != nil {
+		return e
+	}
+	defer rsp.Body.Close()
+
+	var wim = new(wimResponse)
+	if e = json.NewDecoder(rsp.Body).Decode(wim); e != nil {
+		return fmt.Errorf("could not decode %s response with HTTP status %s: %w", reqUrl, rsp.Status, e)
+	}
+
+	if wim.Response == nil {
+		return fmt.Errorf("%s responded without response object", reqUrl)
+	}
+	if e = newAPIError(reqUrl, "", wim.Response.StatusCode, wim.Response.StatusText); e != nil {
+		return e
+	}
+
+	if e = json.Unmarshal(wim.Response.Data, v); e != nil {
+		return e
+	}
+
+	return validateResponse(v)
+}
+
+// signature is base64 of HMAC-SHA256 of data with the key
+func signature(key, data string) string {
+	var mac = hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// wimEncode encodes params sorted by key with spaces as %20 as WIM signatures require
+func wimEncode(params url.Values) string {
+	return strings.ReplaceAll(params.Encode(), "+", "%20")
+}
+
+func wimEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,46 @@
+package app
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSignature(t *testing.T) {
+	var tests = []struct {
+		key, data, want string
+	}{
+		{"", "", "thNnmggU2ex3L5XXeMNfxf8Wl8STcVZTxscSFEKSxa0="},
+		{"key", "The quick brown fox jumps over the lazy dog", "97yD9DBThCSxMpjmqm+xQ+9NWaFJRhdZl0edvC0aPNg="},
+	}
+
+	for _, tt := range tests {
+		if got := signature(tt.key, tt.data); got != tt.want {
+			t.Errorf("got signature %s of %q, want %s", got, tt.data, tt.want)
+		}
+	}
+}
+
+// WIM signs the sorted query with spaces escaped as %20, url.Values encodes them as +
+func TestWimEncode(t *testing.T) {
+	var tests = []struct {
+		params url.Values
+		want   string
+	}{
+		{url.Values{"b": {"2"}, "a": {"1"}}, "a=1&b=2"},
+		{url.Values{"events": {"myInfo,buddylist"}, "language": {"en us"}}, "events=myInfo%2Cbuddylist&language=en%20us"},
+		{url.Values{"s": {"a+b"}}, "s=a%2Bb"},
+	}
+
+	for _, tt := range tests {
+		if got := wimEncode(tt.params); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+
+	if got := wimEscape("https://api.icq.net/aim/startSession"); got != "https%3A%2F%2Fapi.icq.net%2Faim%2FstartSession" {
+		t.Errorf("got escaped url %s", got)
+	}
+	if got := wimEscape("a b"); got != "a%20b" {
+		t.Errorf("got escaped value %s, want a%%20b", got)
+	}
+}
@@ -0,0 +1,238 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	uuid "github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const chatMembersPageSize = 100
+
+// kinds of membership changes of chat_members_changes
+const (
+	memberAdded   = "added"
+	memberRemoved = "removed"
+	memberRole    = "role"
+)
+
+type (
+	// POST /rapi (getChatMembers)
+	getChatMembersReq struct {
+		Method string                   `json:"method,omitempty"`
+		ReqId  string                   `json:"reqId,omitempty"`
+		Aimsid string                   `json:"aimsid,omitempty"`
+		Params *getChatMembersReqParams `json:"params,omitempty"`
+	}
+	getChatMembersReqParams struct {
+		Sn       string `json:"sn,omitempty"`
+		PageSize int    `json:"pageSize,omitempty"`
+		Cursor   string `json:"cursor,omitempty"`
+	}
+
+	getChatMembersRsp struct {
+		Timestamp uint64                   `json:"ts,omitempty"`
+		Status    *getHistoryRspStatus     `json:"status,omitempty"`
+		Method    string                   `json:"method,omitempty"`
+		ReqId     string                   `json:"reqId,omitempty"`
+		Results   *getChatMembersRspResult `json:"results,omitempty"`
+	}
+	getChatMembersRspResult struct {
+		Members []*getChatMembersRspResultMember `json:"members,omitempty"`
+		Cursor  string                           `json:"cursor,omitempty"`
+	}
+	getChatMembersRspResultMember struct {
+		Sn       string `json:"sn,omitempty"`
+		Role     string `json:"role,omitempty"`
+		JoinTime int64  `json:"joinTime,omitempty"`
+		Inviter  string `json:"inviter,omitempty"`
+	}
+)
+
+func (m *ICQApi) getChatMembersPage(ctx context.Context, chatId, cursor string) (page *getChatMembersRspResult, e error) {
+	gLogger.Debug().Str("chatId", chatId).Str("cursor", cursor).Msg("Trying to fetch chat members")
+
+	var reqId = uuid.NewV4()
+
+	var reqUrl *url.URL
+	if reqUrl, e = url.Parse(m.apiUrl + "/rapi"); e != nil {
+		return nil, e
+	}
+
+	var buf = new(bytes.Buffer)
+	if e = json.NewEncoder(buf).Encode(&getChatMembersReq{
+		"getChatMembers", reqId.String(), m.aimsid, &getChatMembersReqParams{chatId, chatMembersPageSize, cursor},
+	}); e != nil {
+		return nil, e
+	}
+
+	var req *http.Request
+	if req, e = http.NewRequestWithContext(ctx, "POST", reqUrl.String(), buf); e != nil {
+		return nil, e
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Ubuntu Chromium/62.0.3202.89 Chrome/62.0.3202.89 Safari/537.36")
+	req.Header.Set("Origin", m.apiUrl+"/rapi")
+	req.Header.Add("X-Requested-With", "XMLHttpRequest")
+
+	var rsp *http.Response
+	if rsp, e = m.do(req, &mongodb.CollectionRAPIRequests{
+		Method: "getChatMembers", ReqId: reqId.String(), Account: m.account,
+		Params: &mongodb.CollectionRAPIRequestsParams{Sn: chatId, Count: chatMembersPageSize, Cursor: cursor},
+	}); e != nil {
+		return nil, e
+	}
+	defer rsp.Body.Close()
+
+	if e = newAPIError("getChatMembers", m.account, rsp.StatusCode, rsp.Status); e != nil {
+		return nil, e
+	}
+
+	var data []byte
+	if data, e = ioutil.ReadAll(rsp.Body); e != nil {
+		return nil, e
+	}
+
+	var membersResponse *getChatMembersRsp
+	if e = json.Unmarshal(data, &membersResponse); e != nil {
+		return nil, e
+	}
+
+	if membersResponse != nil && membersResponse.Status != nil {
+		if e = newAPIError("getChatMembers", m.account, membersResponse.Status.Code, membersResponse.Status.Reason); e != nil {
+			return nil, e
+		}
+	}
+
+	if e = membersResponse.validate(); e != nil {
+		return nil, e
+	}
+
+	return membersResponse.Results, e
+}
+
+// getChatMembers follows page cursors until the last page
+func (m *ICQApi) getChatMembers(ctx context.Context, chatId string) (members []*getChatMembersRspResultMember, e error) {
+	var cursors = make(map[string]bool)
+
+	var cursor string
+	for {
+		var page *getChatMembersRspResult
+		if page, e = m.getChatMembersPage(ctx, chatId, cursor); e != nil {
+			return nil, e
+		}
+		members = append(members, page.Members...)
+
+		if page.Cursor == "" || len(page.Members) == 0 {
+			return members, nil
+		}
+		if cursors[page.Cursor] {
+			return nil, newValidationError("getChatMembers", "cursor", "is repeated")
+		}
+
+		cursor, cursors[page.Cursor] = page.Cursor, true
+	}
+}
+
+func newChatMember(chatId string, member *getChatMembersRspResultMember, seenAt time.Time) *mongodb.CollectionChatMembers {
+	var record = &mongodb.CollectionChatMembers{
+		ChatId:   chatId,
+		Sn:       member.Sn,
+		Role:     member.Role,
+		Inviter:  member.Inviter,
+		LastSeen: seenAt,
+	}
+
+	if member.JoinTime != 0 {
+		var joinedAt = time.Unix(member.JoinTime, 0)
+		record.JoinedAt = &joinedAt
+	}
+
+	return record
+}
+
+// saveChatMembers replaces the membership snapshot of the chat: current members are upserted, missing ones
+// are marked removed, and additions, removals and role changes are recorded in chat_members_changes
+func saveChatMembers(ctx context.Context, chatId string, members []*getChatMembersRspResultMember) (e error) {
+	var stored []*mongodb.CollectionChatMembers
+	if e = gMongoDB.Find(ctx, "chat_members", bson.M{"chatId": chatId}, &stored); e != nil {
+		return e
+	}
+
+	// the first snapshot of the chat records no changes
+	var initial = len(stored) == 0
+
+	var previous = make(map[string]*mongodb.CollectionChatMembers, len(stored))
+	for _, v := range stored {
+		if v.RemovedAt == nil {
+			previous[v.Sn] = v
+		}
+	}
+
+	var now = time.Now()
+	var models []mongo.WriteModel
+	var changes []interface{}
+	for _, v := range members {
+		var member = newChatMember(chatId, v, now)
+
+		if prev, ok := previous[v.Sn]; !ok {
+			changes = append(changes, &mongodb.CollectionChatMembersChanges{
+				ChatId: chatId, Sn: v.Sn, Change: memberAdded, Role: v.Role, ChangedAt: now,
+			})
+		} else if prev.Role != v.Role {
+			changes = append(changes, &mongodb.CollectionChatMembersChanges{
+				ChatId: chatId, Sn: v.Sn, Change: memberRole, Role: v.Role, PreviousRole: prev.Role, ChangedAt: now,
+			})
+		}
+		delete(previous, v.Sn)
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"chatId": chatId, "sn": v.Sn}).
+			SetUpdate(bson.M{
+				"$set":         member,
+				"$setOnInsert": bson.M{"firstSeen": now},
+				"$unset":       bson.M{"removedAt": ""},
+			}).
+			SetUpsert(true))
+	}
+
+	for sn, prev := range previous {
+		changes = append(changes, &mongodb.CollectionChatMembersChanges{
+			ChatId: chatId, Sn: sn, Change: memberRemoved, PreviousRole: prev.Role, ChangedAt: now,
+		})
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"chatId": chatId, "sn": sn}).
+			SetUpdate(bson.M{"$set": bson.M{"removedAt": now}}))
+	}
+
+	if len(models) != 0 {
+		if _, e = gMongoDB.BulkWrite(ctx, "chat_members", models, options.BulkWrite().SetOrdered(false)); e != nil {
+			return e
+		}
+	}
+
+	if initial {
+		changes = nil
+	}
+
+	if len(changes) != 0 {
+		if e = gMongoDB.InsertMany(ctx, "chat_members_changes", &changes); e != nil {
+			return e
+		}
+	}
+
+	gLogger.Info().Str("chatId", chatId).Int("members", len(members)).Int("changes", len(changes)).
+		Msg("Chat members have been successfully saved")
+	return nil
+}
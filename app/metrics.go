@@ -0,0 +1,187 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "icqdumper"
+
+type (
+	appMetrics struct {
+		registry *prometheus.Registry
+
+		apiRequests         *prometheus.CounterVec
+		apiLatency          *prometheus.HistogramVec
+		chatPagesFetched    *prometheus.CounterVec
+		chatMessagesFetched *prometheus.CounterVec
+		dbWriteLatency      *prometheus.HistogramVec
+		dbWriteErrors       *prometheus.CounterVec
+	}
+	// queueCollector reads dispatchers and job metrics on every scrape
+	queueCollector struct {
+		pending, workers, inflight, retries, dead *prometheus.Desc
+	}
+)
+
+func newAppMetrics() *appMetrics {
+	var m = &appMetrics{
+		registry: prometheus.NewRegistry(),
+		apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_requests_total",
+			Help:      "ICQ API requests by method and response status.",
+		}, []string{"method", "status"}),
+		apiLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_request_duration_seconds",
+			Help:      "ICQ API request latency.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 8),
+		}, []string{"method"}),
+		chatPagesFetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "chat_pages_fetched_total",
+			Help:      "History pages fetched per chat.",
+		}, []string{"chat"}),
+		chatMessagesFetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "chat_messages_fetched_total",
+			Help:      "History messages fetched per chat.",
+		}, []string{"chat"}),
+		dbWriteLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_write_duration_seconds",
+			Help:      "MongoDB write latency by operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 10),
+		}, []string{"operation"}),
+		dbWriteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_write_errors_total",
+			Help:      "Failed MongoDB writes by operation.",
+		}, []string{"operation"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newQueueCollector(),
+		m.apiRequests,
+		m.apiLatency,
+		m.chatPagesFetched,
+		m.chatMessagesFetched,
+		m.dbWriteLatency,
+		m.dbWriteErrors,
+	)
+
+	return m
+}
+
+// observe methods are no-op for commands without the dump pipeline
+func (m *appMetrics) observeAPI(method string, started time.Time, rsp *http.Response, e error) {
+	if m == nil {
+		return
+	}
+
+	var status = "error"
+	if e == nil {
+		status = strconv.Itoa(rsp.StatusCode)
+	}
+
+	m.apiRequests.WithLabelValues(method, status).Inc()
+	m.apiLatency.WithLabelValues(method).Observe(time.Since(started).Seconds())
+}
+
+func (m *appMetrics) observeDBWrite(operation string, started time.Time, e error) {
+	if m == nil {
+		return
+	}
+
+	m.dbWriteLatency.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+	if e != nil {
+		m.dbWriteErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (m *appMetrics) observePage(chatId string, messages int) {
+	if m == nil {
+		return
+	}
+
+	m.chatPagesFetched.WithLabelValues(chatId).Inc()
+	m.chatMessagesFetched.WithLabelValues(chatId).Add(float64(messages))
+}
+
+// serve exposes metrics on listen until ctx is done
+func (m *appMetrics) serve(ctx context.Context, listen string) error {
+	var mux = http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	var server = &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	gLogger.Info().Str("listen", listen).Msg("Metrics endpoint has been successfully started")
+	if e := server.ListenAndServe(); e != http.ErrServerClosed {
+		return e
+	}
+
+	return nil
+}
+
+func newQueueCollector() *queueCollector {
+	return &queueCollector{
+		pending: prometheus.NewDesc(metricsNamespace+"_queue_pending_jobs",
+			"Jobs pushed to the dispatcher and not finished yet.", []string{"queue"}, nil),
+		workers: prometheus.NewDesc(metricsNamespace+"_queue_workers",
+			"Current dispatcher worker pool size.", []string{"queue"}, nil),
+		inflight: prometheus.NewDesc(metricsNamespace+"_jobs_inflight",
+			"Jobs being executed by workers.", []string{"type"}, nil),
+		retries: prometheus.NewDesc(metricsNamespace+"_job_retries_total",
+			"Failed jobs scheduled for retry.", []string{"type"}, nil),
+		dead: prometheus.NewDesc(metricsNamespace+"_jobs_dead_lettered_total",
+			"Jobs moved to dead letters after exceeding retry limit.", []string{"type"}, nil),
+	}
+}
+
+func (m *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.pending
+	ch <- m.workers
+	ch <- m.inflight
+	ch <- m.retries
+	ch <- m.dead
+}
+
+func (m *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, dp := range []*dispatcher{gChatsQueue, gDBQueue} {
+		if dp == nil {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(m.pending, prometheus.GaugeValue, float64(dp.getPending()), dp.name)
+		ch <- prometheus.MustNewConstMetric(m.workers, prometheus.GaugeValue, float64(dp.getWorkers()), dp.name)
+	}
+
+	if gJobMetrics == nil {
+		return
+	}
+
+	var types, metrics = gJobMetrics.snapshot()
+	for _, v := range types {
+		ch <- prometheus.MustNewConstMetric(m.inflight, prometheus.GaugeValue, float64(metrics[v].Running), v)
+		ch <- prometheus.MustNewConstMetric(m.retries, prometheus.CounterValue, float64(metrics[v].Retried), v)
+		ch <- prometheus.MustNewConstMetric(m.dead, prometheus.CounterValue, float64(metrics[v].Dropped), v)
+	}
+}
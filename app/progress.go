@@ -0,0 +1,153 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	UIModeNone  = "none"
+	UIModeTUI   = "tui"
+	UIModePlain = "plain"
+)
+
+type (
+	progress struct {
+		chatsQueued     int64
+		chatsDone       int64
+		pagesFetched    int64
+		messagesFetched int64
+		messagesSaved   int64
+
+		started time.Time
+	}
+	progressSnapshot struct {
+		ChatsQueued, ChatsDone, PagesFetched       int64
+		MessagesFetched, MessagesSaved, JobsFailed int64
+		JobsInterrupted                            int64
+		ChatsQueuePending, DBQueuePending          int64
+		ChatsWorkers, DBWorkers                    int64
+		Elapsed                                    time.Duration
+
+		JobTypes []string
+		Jobs     map[string]jobTypeMetrics
+	}
+)
+
+func newProgress() *progress {
+	return &progress{
+		started: time.Now(),
+	}
+}
+
+func (m *progress) snapshot(chatsDp, dbDp *dispatcher) *progressSnapshot {
+	var snap = &progressSnapshot{
+		ChatsQueued:     atomic.LoadInt64(&m.chatsQueued),
+		ChatsDone:       atomic.LoadInt64(&m.chatsDone),
+		PagesFetched:    atomic.LoadInt64(&m.pagesFetched),
+		MessagesFetched: atomic.LoadInt64(&m.messagesFetched),
+		MessagesSaved:   atomic.LoadInt64(&m.messagesSaved),
+		Elapsed:         time.Since(m.started).Truncate(time.Second),
+	}
+
+	snap.JobTypes, snap.Jobs = gJobMetrics.snapshot()
+	for _, v := range snap.Jobs {
+		snap.JobsFailed += v.Dropped
+		snap.JobsInterrupted += v.Interrupted
+	}
+
+	if chatsDp != nil {
+		snap.ChatsQueuePending = chatsDp.getPending()
+		snap.ChatsWorkers = chatsDp.getWorkers()
+	}
+	if dbDp != nil {
+		snap.DBQueuePending = dbDp.getPending()
+		snap.DBWorkers = dbDp.getWorkers()
+	}
+
+	return snap
+}
+
+func (m *progressSnapshot) lines() (lines []string) {
+	lines = []string{
+		fmt.Sprintf("Elapsed:          %s", m.Elapsed),
+		fmt.Sprintf("Chats:            %d / %d", m.ChatsDone, m.ChatsQueued),
+		fmt.Sprintf("Pages fetched:    %d", m.PagesFetched),
+		fmt.Sprintf("Messages fetched: %d", m.MessagesFetched),
+		fmt.Sprintf("Messages saved:   %d", m.MessagesSaved),
+		fmt.Sprintf("Failed jobs:      %d", m.JobsFailed),
+		fmt.Sprintf("Interrupted jobs: %d", m.JobsInterrupted),
+		fmt.Sprintf("Pending jobs:     chats %d, db %d", m.ChatsQueuePending, m.DBQueuePending),
+		fmt.Sprintf("Workers:          chats %d, db %d", m.ChatsWorkers, m.DBWorkers),
+		"",
+	}
+
+	for _, v := range m.JobTypes {
+		var jm = m.Jobs[v]
+		lines = append(lines, fmt.Sprintf("%-20s queued %d, running %d, done %d, failed %d, retried %d, dropped %d, avg %s",
+			v+":", jm.Queued, jm.Running, jm.Done, jm.Failed, jm.Retried, jm.Dropped, jm.avgDuration()))
+	}
+
+	return lines
+}
+
+func (m *progressSnapshot) log(l *zerolog.Logger, msg string) {
+	var jobs = zerolog.Dict()
+	for _, v := range m.JobTypes {
+		var jm = m.Jobs[v]
+		jobs.Dict(v, zerolog.Dict().
+			Int64("queued", jm.Queued).
+			Int64("running", jm.Running).
+			Int64("done", jm.Done).
+			Int64("failed", jm.Failed).
+			Int64("retried", jm.Retried).
+			Int64("dropped", jm.Dropped).
+			Int64("interrupted", jm.Interrupted).
+			Dur("avg_duration", jm.avgDuration()))
+	}
+
+	l.Info().
+		Dur("elapsed", m.Elapsed).
+		Int64("chats_queued", m.ChatsQueued).
+		Int64("chats_done", m.ChatsDone).
+		Int64("pages_fetched", m.PagesFetched).
+		Int64("messages_fetched", m.MessagesFetched).
+		Int64("messages_saved", m.MessagesSaved).
+		Int64("jobs_failed", m.JobsFailed).
+		Int64("jobs_interrupted", m.JobsInterrupted).
+		Int64("chats_pending", m.ChatsQueuePending).
+		Int64("db_pending", m.DBQueuePending).
+		Int64("chats_workers", m.ChatsWorkers).
+		Int64("db_workers", m.DBWorkers).
+		Dict("jobs", jobs).
+		Msg(msg)
+}
+
+func (m *jobTypeMetrics) avgDuration() time.Duration {
+	var runs = m.Done + m.Failed + m.Interrupted
+	if runs == 0 {
+		return 0
+	}
+
+	return (m.Duration / time.Duration(runs)).Truncate(time.Millisecond)
+}
+
+func (m *App) reportProgress(done <-chan struct{}, interval time.Duration) {
+	var log = zerolog.New(os.Stderr).With().Timestamp().Str("component", "progress").Logger()
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			gProgress.snapshot(m.chatsDispatcher, m.databaseDispatcher).log(&log, "dump progress (final)")
+			return
+		case <-ticker.C:
+			gProgress.snapshot(m.chatsDispatcher, m.databaseDispatcher).log(&log, "dump progress")
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
 	"sync"
-)
+	"sync/atomic"
+	"time"
 
-const (
-	jobActParseChatMessages = uint8(iota)
-	jobActSaveChatMessage
-	jobActCustomFunc
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	uuid "github.com/satori/go.uuid"
 )
 
 const (
@@ -18,40 +22,92 @@ const (
 	jobStatusDone
 )
 
+const jobMaxFails = 3
+
 type (
-	job struct {
-		payload     []interface{}
-		payloadFunc func([]interface{}) error
+	Job interface {
+		ID() string
+		Type() string
+		String() string
+		Key() string
+		Run(ctx context.Context) error
+
+		state() *jobState
+		payload() interface{}
+	}
+	// batchJob can be executed in one run together with queued jobs of the same type
+	batchJob interface {
+		Job
+		size() int
+		runBatch(ctx context.Context, jobs []Job) error
+	}
+	jobState struct {
+		id          string
 		status      uint8
-		action      uint8
 		failedCount uint8
+		created     time.Time
+		attempts    []mongodb.CollectionJobsError
 	}
 	jobError struct {
 		e   error
-		job *job
+		job Job
+	}
+	jobMetrics struct {
+		sync.Mutex
+		types map[string]*jobTypeMetrics
+	}
+	jobTypeMetrics struct {
+		Queued, Running, Done, Failed, Retried, Dropped, Interrupted int64
+		Duration                                                     time.Duration
 	}
 	worker struct {
-		pool  chan chan *job
-		inbox chan *job
+		ctx   context.Context
+		dp    *dispatcher
+		pool  chan chan Job
+		inbox chan Job
 
 		done   chan struct{}
 		errors chan *jobError
 	}
 	dispatcher struct {
-		queue      chan *job
-		pool       chan chan *job
+		ctx        context.Context
+		name       string
+		queue      chan Job
+		pool       chan chan Job
 		done       chan struct{}
 		workerDone chan struct{}
 		errorPipe  chan *jobError
 
+		// durable backend; jobs are leased from store into queue while there are free slots
+		store jobStore
+		slots chan struct{}
+
+		// ordered dispatcher routes jobs with the same key to the same worker
+		// and groups them into batches of batchSize waiting up to linger
+		ordered   bool
+		shards    []chan Job
+		batchSize int
+		linger    time.Duration
+
+		// autoscaled pool size is changed by retiring idle workers at once and busy ones after their job,
+		// retire is the number of busy workers to stop
+		scaler            *autoscaler
+		workers, retire   int64
+		runs, fails, busy int64
+
 		workerCapacity int
+		pending        int64
+
+		// in-memory and ordered in-place retries wait retryDelay multiplied by the number of failures
+		retryDelay time.Duration
 	}
 )
 
-func newDispatcher(queueBuffer, workerCapacity int) *dispatcher {
+func newDispatcher(name string, queueBuffer, workerCapacity int) *dispatcher {
 	return &dispatcher{
-		queue:          make(chan *job, queueBuffer),
-		pool:           make(chan chan *job, workerCapacity),
+		name:           name,
+		queue:          make(chan Job, queueBuffer),
+		pool:           make(chan chan Job, workerCapacity),
 		done:           make(chan struct{}, 1),
 		workerDone:     make(chan struct{}, 1),
 		workerCapacity: workerCapacity,
@@ -59,48 +115,125 @@ func newDispatcher(queueBuffer, workerCapacity int) *dispatcher {
 	}
 }
 
+func newDurableDispatcher(name string, store jobStore, prefetch, workerCapacity int) *dispatcher {
+	var dp = newDispatcher(name, prefetch, workerCapacity)
+	dp.store = store
+	dp.slots = make(chan struct{}, prefetch)
+	return dp
+}
+
+// withOrdering keeps jobs of one key in the push order, failed jobs are retried in place
+func (m *dispatcher) withOrdering(batchSize int, linger time.Duration) *dispatcher {
+	m.ordered = true
+	m.batchSize = batchSize
+	m.linger = linger
+	return m
+}
+
+// withRetryDelay delays in-memory retries of failed jobs, durable stores delay them with visibility timeouts
+func (m *dispatcher) withRetryDelay(delay time.Duration) *dispatcher {
+	m.retryDelay = delay
+	return m
+}
+
+// withAutoscaling resizes the unordered worker pool in min..max bounds
+func (m *dispatcher) withAutoscaling(scaler *autoscaler) *dispatcher {
+	scaler.dp = m
+	m.scaler = scaler
+	return m
+}
+
 func newWorker(dp *dispatcher) *worker {
 	return &worker{
+		ctx:    dp.ctx,
+		dp:     dp,
 		pool:   dp.pool,
-		inbox:  make(chan *job, dp.workerCapacity),
+		inbox:  make(chan Job, dp.workerCapacity),
 		done:   dp.workerDone,
 		errors: dp.errorPipe,
 	}
 }
 
-func newJob() *job {
-	return &job{
-		status: jobStatusCreated,
+func newJobState() jobState {
+	return jobState{
+		id:      uuid.NewV4().String(),
+		status:  jobStatusCreated,
+		created: time.Now(),
 	}
 }
 
-func (m *dispatcher) bootstrap(workers int) (e error) {
+func newJobMetrics() *jobMetrics {
+	return &jobMetrics{
+		types: make(map[string]*jobTypeMetrics),
+	}
+}
+
+func (m *dispatcher) bootstrap(ctx context.Context, workers int) (e error) {
 	gLogger.Debug().Msg("Starting worker spawning...")
+	m.ctx = ctx
 
 	var waitGroup sync.WaitGroup
-	waitGroup.Add(workers + 1)
+	waitGroup.Add(1)
+
+	if m.store != nil {
+		var stored int64
+		if stored, e = m.store.count(ctx); e != nil {
+			return e
+		}
+
+		gLogger.Info().Int64("jobs", stored).Msg("Resuming jobs from the persistent queue")
+		atomic.AddInt64(&m.pending, stored)
 
-	for i := 0; i < workers; i++ {
-		go func(wg sync.WaitGroup) {
-			newWorker(m).spawn()
+		waitGroup.Add(1)
+		go func(wg *sync.WaitGroup) {
+			m.feed()
 			wg.Done()
-		}(waitGroup)
+		}(&waitGroup)
 	}
 
-	go func(wg sync.WaitGroup) {
+	if m.ordered {
+		// the shards count defines jobs routing, so ordered pools are never resized
+		m.shards = make([]chan Job, workers)
+		for i := range m.shards {
+			var wrk = newWorker(m)
+			m.shards[i] = wrk.inbox
+
+			waitGroup.Add(1)
+			atomic.AddInt64(&m.workers, 1)
+			go func(wg *sync.WaitGroup) {
+				wrk.spawnOrdered()
+				atomic.AddInt64(&m.workers, -1)
+				wg.Done()
+			}(&waitGroup)
+		}
+	} else {
+		for i := 0; i < workers; i++ {
+			m.spawnWorker(&waitGroup)
+		}
+
+		if m.scaler != nil {
+			waitGroup.Add(1)
+			go func(wg *sync.WaitGroup) {
+				m.scaler.run(wg)
+				wg.Done()
+			}(&waitGroup)
+		}
+	}
+
+	go func(wg *sync.WaitGroup) {
 		m.dispatch()
 		close(m.workerDone)
 		wg.Done()
-	}(waitGroup)
+	}(&waitGroup)
 
-	gLogger.Info().Int("workers count", workers).Msg("Workers has been spawned successfully")
+	gLogger.Info().Int64("workers count", m.getWorkers()).Msg("Workers has been spawned successfully")
 	waitGroup.Wait()
 
 	return
 }
 
 func (m *dispatcher) dispatch() {
-	var jbBuf *job
+	var jbBuf Job
 
 	gLogger.Info().Msg("Dispatching has been successfully started")
 
@@ -109,23 +242,262 @@ func (m *dispatcher) dispatch() {
 		case <-m.done:
 			return
 		case jbBuf = <-m.queue:
-			go func(jb *job) {
+			if m.ordered {
+				select {
+				case m.shards[m.shard(jbBuf.Key())] <- jbBuf:
+				case <-m.done:
+					return
+				}
+				continue
+			}
+
+			go func(jb Job) {
 				nextWorker := <-m.pool
 				nextWorker <- jb
 			}(jbBuf)
 		case jbErr := <-m.errorPipe:
-			if jbErr.job.failedCount != 3 {
-				gLogger.Info().Msg("Trying to restart failed job...")
-				m.queue <- jbErr.job
+			if !retryable(jbErr.e) {
+				m.exhaust(jbErr)
+				continue
+			}
+
+			if m.store != nil {
+				m.failStored(jbErr)
+				continue
+			}
+
+			if jbErr.job.state().failedCount < jobMaxFails {
+				gLogger.Info().Str("job", jbErr.job.ID()).Str("type", jbErr.job.Type()).Msg("Trying to restart failed job...")
+				gJobMetrics.add(jbErr.job.Type(), func(tm *jobTypeMetrics) { tm.Retried++ })
+				go m.retry(jbErr.job)
 			} else {
-				gLogger.Error().Msg("Could not restart failed job! Fails count is more or equal 3!")
+				m.exhaust(jbErr)
+			}
+		}
+	}
+}
+
+// retry queues the failed job again after the backoff; the dispatcher loop never blocks on its own queue
+func (m *dispatcher) retry(jb Job) {
+	var timer = time.NewTimer(m.retryDelay * time.Duration(jb.state().failedCount))
+	defer timer.Stop()
+
+	select {
+	case <-m.done:
+		return
+	case <-timer.C:
+	}
+
+	select {
+	case <-m.done:
+	case m.queue <- jb:
+	}
+}
+
+func (m *dispatcher) spawnWorker(wg *sync.WaitGroup) {
+	wg.Add(1)
+	atomic.AddInt64(&m.workers, 1)
+
+	go func() {
+		newWorker(m).spawn()
+		atomic.AddInt64(&m.workers, -1)
+		wg.Done()
+	}()
+}
+
+// retired takes one retire request for the worker
+func (m *dispatcher) retired() bool {
+	for {
+		var retire = atomic.LoadInt64(&m.retire)
+		if retire <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.retire, retire, retire-1) {
+			return true
+		}
+	}
+}
+
+// retireWorkers stops idle workers taken from the pool with a nil job, the rest of count
+// is taken by busy workers when they finish their jobs
+func (m *dispatcher) retireWorkers(count int64) {
+	for ; count > 0; count-- {
+		select {
+		case inbox := <-m.pool:
+			inbox <- nil
+		default:
+			atomic.AddInt64(&m.retire, count)
+			return
+		}
+	}
+}
+
+func (m *dispatcher) shard(key string) int {
+	var hash = fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(m.shards)))
+}
+
+// feed leases jobs from the durable store while the dispatcher has free slots
+func (m *dispatcher) feed() {
+	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case m.slots <- struct{}{}:
+		}
+
+		for {
+			// cancelled dispatcher does not take new jobs, they stay in the store for the next run
+			if m.ctx.Err() != nil {
+				<-m.slots
+				return
+			}
+
+			var jb, e = m.store.lease(m.ctx)
+			if e != nil && m.ctx.Err() == nil {
+				gLogger.Warn().Err(e).Msg("Could not lease job from the persistent queue")
+			} else if jb != nil {
+				m.queue <- jb
+				break
+			}
+
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
 			}
 		}
 	}
 }
 
-func (m *dispatcher) getQueueChan() chan *job {
-	return m.queue
+func (m *dispatcher) failStored(jbErr *jobError) {
+	if jbErr.job.state().failedCount >= jobMaxFails {
+		m.exhaust(jbErr)
+		return
+	}
+
+	if e := m.store.fail(context.Background(), jbErr.job, jbErr.e, false); e != nil {
+		gLogger.Error().Err(e).Str("job", jbErr.job.ID()).Msg("Could not save failed job state to the persistent queue")
+	}
+
+	gJobMetrics.add(jbErr.job.Type(), func(tm *jobTypeMetrics) { tm.Retried++ })
+	<-m.slots
+}
+
+// exhaust moves the job that has exceeded retry limit or failed with a non retryable error to dead letters;
+// auth errors abort the run, all other jobs of the account would fail the same way
+func (m *dispatcher) exhaust(jbErr *jobError) {
+	gLogger.Error().Err(jbErr.e).Str("job", jbErr.job.ID()).Str("type", jbErr.job.Type()).
+		Str("payload", jbErr.job.String()).Uint8("failed tries", jbErr.job.state().failedCount).
+		Bool("retryable", retryable(jbErr.e)).Msg("Job has failed and has been moved to dead letters")
+
+	if errors.Is(jbErr.e, ErrAuthExpired) {
+		abortRun(jbErr.e)
+	}
+	gRun.error(jbErr.job.ID(), fmt.Errorf("%s %s: %w", jbErr.job.Type(), jbErr.job.String(), jbErr.e))
+
+	var e error
+	if m.store != nil {
+		e = m.store.fail(context.Background(), jbErr.job, jbErr.e, true)
+	} else {
+		e = buryJob(context.Background(), m.name, jbErr.job)
+	}
+
+	if e != nil {
+		gLogger.Error().Err(e).Str("job", jbErr.job.ID()).Msg("Could not save failed job to dead letters")
+	}
+
+	gJobMetrics.add(jbErr.job.Type(), func(tm *jobTypeMetrics) { tm.Dropped++ })
+	atomic.AddInt64(&m.pending, -1)
+
+	if m.store != nil {
+		<-m.slots
+	}
+}
+
+// complete is called by workers for finished and interrupted jobs
+func (m *dispatcher) complete(jb Job, interrupted bool) {
+	if m.store != nil {
+		var e error
+		if interrupted {
+			e = m.store.release(context.Background(), jb)
+		} else {
+			e = m.store.ack(context.Background(), jb)
+		}
+
+		if e != nil {
+			gLogger.Warn().Err(e).Str("job", jb.ID()).Msg("Could not update job in the persistent queue, it will be redelivered")
+		}
+
+		<-m.slots
+	}
+
+	atomic.AddInt64(&m.pending, -1)
+}
+
+// resumes reports whether the durable store already has a job of the given type and key
+func (m *dispatcher) resumes(ctx context.Context, jobType, key string) (ok bool, e error) {
+	if m.store == nil {
+		return false, nil
+	}
+
+	return m.store.has(ctx, jobType, key)
+}
+
+func (m *dispatcher) push(ctx context.Context, jb Job) (e error) {
+	if m.store != nil {
+		if e = m.store.push(ctx, jb); e != nil {
+			return e
+		}
+
+		atomic.AddInt64(&m.pending, 1)
+		gJobMetrics.add(jb.Type(), func(tm *jobTypeMetrics) { tm.Queued++ })
+		return nil
+	}
+
+	atomic.AddInt64(&m.pending, 1)
+
+	select {
+	case m.queue <- jb:
+		gJobMetrics.add(jb.Type(), func(tm *jobTypeMetrics) { tm.Queued++ })
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt64(&m.pending, -1)
+		return ctx.Err()
+	}
+}
+
+// waitIdle blocks until all pushed jobs are done or ctx is expired;
+// with inflightOnly jobs left in the durable store are not waited for
+func (m *dispatcher) waitIdle(ctx context.Context, inflightOnly bool) bool {
+	var ticker = time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for m.getPending() != 0 {
+		if inflightOnly && m.store != nil && len(m.slots) == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+
+	return true
+}
+
+func (m *dispatcher) getPending() int64 {
+	return atomic.LoadInt64(&m.pending)
+}
+
+func (m *dispatcher) getWorkers() int64 {
+	return atomic.LoadInt64(&m.workers)
 }
 
 func (m *dispatcher) destroy() {
@@ -133,56 +505,230 @@ func (m *dispatcher) destroy() {
 }
 
 func (m *worker) spawn() {
-	defer close(m.inbox)
-
 	for {
-		m.pool <- m.inbox
+		if m.dp.retired() {
+			return
+		}
+
 		select {
 		case <-m.done:
+			return
+		case m.pool <- m.inbox:
+		}
+
+		select {
+		case <-m.done:
+			return
 		case buf := <-m.inbox:
-			buf.setStatus(jobStatusPending)
+			// nil job retires the idle worker, its inbox has been taken from the pool
+			if buf == nil {
+				return
+			}
+
+			buf.state().status = jobStatusPending
 			m.doJob(buf)
 		}
 	}
 }
 
-func (m *worker) doJob(jb *job) {
+// spawnOrdered runs jobs of the worker shard one by one in the push order
+func (m *worker) spawnOrdered() {
+	var next Job
 
-	switch jb.action {
-	case jobActParseChatMessages:
-	case jobActSaveChatMessage:
-	case jobActCustomFunc:
-		if jb.payloadFunc != nil {
-			if e := jb.payloadFunc(jb.payload); e != nil {
-				m.errors <- jb.newError(e)
+	for {
+		var jb = next
+		if jb == nil {
+			select {
+			case <-m.done:
+				return
+			case jb = <-m.inbox:
 			}
-		} else {
-			gLogger.Warn().Msg("Job has undefined action")
 		}
+
+		var jobs []Job
+		jobs, next = m.collect(jb)
+		m.doOrdered(jobs)
 	}
 }
 
-func (m *job) setStatus(status uint8) {
-	if status == jobStatusFailed {
-		m.failedCount++
+// collect groups the batch job with the following jobs of the same type from the inbox;
+// the first job of another type is returned as next
+func (m *worker) collect(jb Job) (jobs []Job, next Job) {
+	jobs = []Job{jb}
+
+	var bj, ok = jb.(batchJob)
+	if !ok {
+		return jobs, nil
+	}
+
+	var size = bj.size()
+	var timer = time.NewTimer(m.dp.linger)
+	defer timer.Stop()
+
+	for size < m.dp.batchSize {
+		select {
+		case <-m.done:
+			return jobs, nil
+		case <-timer.C:
+			return jobs, nil
+		case next = <-m.inbox:
+			var nbj, ok = next.(batchJob)
+			if !ok || next.Type() != jb.Type() {
+				return jobs, next
+			}
+
+			jobs = append(jobs, next)
+			size += nbj.size()
+		}
 	}
 
-	m.status = status
+	return jobs, nil
 }
 
-func (m *job) newError(e error) *jobError {
-	m.setStatus(jobStatusFailed)
-	gLogger.Warn().Err(e).Uint8("failed tries", m.failedCount).Msg("Could not exec job. Job state now is Failed")
+func (m *worker) doJob(jb Job) {
+	switch e := m.run([]Job{jb}); {
+	case e == nil:
+		m.finish(jb, false)
+	case m.ctx.Err() != nil:
+		gLogger.Warn().Err(e).Str("job", jb.ID()).Str("type", jb.Type()).Str("payload", jb.String()).
+			Msg("Job has been interrupted by application shutdown")
+		m.finish(jb, true)
+	default:
+		select {
+		case m.errors <- newJobError(jb, e):
+		case <-m.done:
+		}
+	}
+}
+
+// doOrdered retries failed jobs in place after the retry delay, so the following jobs of the shard wait for them
+func (m *worker) doOrdered(jobs []Job) {
+	for {
+		var e = m.run(jobs)
+		if e == nil || m.ctx.Err() != nil {
+			if e != nil {
+				gLogger.Warn().Err(e).Int("jobs", len(jobs)).Str("type", jobs[0].Type()).
+					Msg("Jobs have been interrupted by application shutdown")
+			}
+
+			for _, jb := range jobs {
+				m.finish(jb, e != nil)
+			}
+			return
+		}
+
+		var jbErrs = make([]*jobError, 0, len(jobs))
+		for _, jb := range jobs {
+			jbErrs = append(jbErrs, newJobError(jb, e))
+		}
+
+		var failedCount = jobs[0].state().failedCount
+		if failedCount >= jobMaxFails || !retryable(e) {
+			for _, jbErr := range jbErrs {
+				m.dp.exhaust(jbErr)
+			}
+			return
+		}
+
+		for _, jb := range jobs {
+			gJobMetrics.add(jb.Type(), func(tm *jobTypeMetrics) { tm.Retried++ })
+		}
+
+		var timer = time.NewTimer(m.dp.retryDelay * time.Duration(failedCount))
+		select {
+		case <-m.done:
+			timer.Stop()
+			return
+		case <-m.ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (m *worker) run(jobs []Job) (e error) {
+	var jobType = jobs[0].Type()
+	gJobMetrics.add(jobType, func(tm *jobTypeMetrics) { tm.Running += int64(len(jobs)) })
+
+	var started = time.Now()
+	if len(jobs) == 1 {
+		e = jobs[0].Run(m.ctx)
+	} else {
+		e = jobs[0].(batchJob).runBatch(m.ctx, jobs)
+	}
+
+	var elapsed = time.Since(started)
+	gJobMetrics.add(jobType, func(tm *jobTypeMetrics) {
+		tm.Running -= int64(len(jobs))
+		tm.Duration += elapsed / time.Duration(len(jobs))
+	})
+
+	atomic.AddInt64(&m.dp.runs, int64(len(jobs)))
+	atomic.AddInt64(&m.dp.busy, int64(elapsed))
+	if e != nil && m.ctx.Err() == nil {
+		atomic.AddInt64(&m.dp.fails, int64(len(jobs)))
+	}
+
+	return e
+}
+
+func (m *worker) finish(jb Job, interrupted bool) {
+	if interrupted {
+		gJobMetrics.add(jb.Type(), func(tm *jobTypeMetrics) { tm.Interrupted++ })
+	} else {
+		jb.state().status = jobStatusDone
+		gJobMetrics.add(jb.Type(), func(tm *jobTypeMetrics) { tm.Done++ })
+	}
+
+	m.dp.complete(jb, interrupted)
+}
+
+func newJobError(jb Job, e error) *jobError {
+	var state = jb.state()
+	state.status = jobStatusFailed
+	state.failedCount++
+	state.attempts = append(state.attempts, mongodb.CollectionJobsError{
+		Attempt: int(state.failedCount),
+		Error:   e.Error(),
+		Time:    time.Now(),
+	})
+
+	gJobMetrics.add(jb.Type(), func(tm *jobTypeMetrics) { tm.Failed++ })
+	gLogger.Warn().Err(e).Str("job", jb.ID()).Str("type", jb.Type()).Str("payload", jb.String()).
+		Uint8("failed tries", state.failedCount).Msg("Could not exec job. Job state now is Failed")
+
 	return &jobError{
 		e:   e,
-		job: m,
+		job: jb,
 	}
 }
 
-func (m *job) parseChatMessages() (e error) {
-	return
+func (m *jobState) ID() string       { return m.id }
+func (m *jobState) state() *jobState { return m }
+
+func (m *jobMetrics) add(jobType string, f func(*jobTypeMetrics)) {
+	m.Lock()
+	defer m.Unlock()
+
+	var tm, ok = m.types[jobType]
+	if !ok {
+		tm = new(jobTypeMetrics)
+		m.types[jobType] = tm
+	}
+
+	f(tm)
 }
 
-func (m *job) saveChatMessage(e error) {
-	return
+func (m *jobMetrics) snapshot() (types []string, metrics map[string]jobTypeMetrics) {
+	m.Lock()
+	defer m.Unlock()
+
+	metrics = make(map[string]jobTypeMetrics, len(m.types))
+	for k, v := range m.types {
+		types = append(types, k)
+		metrics[k] = *v
+	}
+
+	sort.Strings(types)
+	return types, metrics
 }
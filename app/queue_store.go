@@ -0,0 +1,219 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	QueueBackendMemory  = "memory"
+	QueueBackendMongoDB = "mongodb"
+)
+
+const (
+	jobRecordReady  = "ready"
+	jobRecordLeased = "leased"
+	jobRecordDead   = "dead"
+)
+
+type (
+	// jobStore is a durable queue backend with at-least-once delivery:
+	// leased jobs become visible again if they are not acked until the lease expires
+	jobStore interface {
+		push(ctx context.Context, jb Job) error
+		lease(ctx context.Context) (Job, error)
+		ack(ctx context.Context, jb Job) error
+		release(ctx context.Context, jb Job) error
+		fail(ctx context.Context, jb Job, e error, dead bool) error
+		count(ctx context.Context) (int64, error)
+		has(ctx context.Context, jobType, key string) (bool, error)
+	}
+	mongoJobStore struct {
+		queue      string
+		owner      string
+		accounts   icqAccounts
+		visibility time.Duration
+		retryDelay time.Duration
+	}
+)
+
+func newMongoJobStore(queue, owner string, accounts icqAccounts, visibility, retryDelay time.Duration) *mongoJobStore {
+	return &mongoJobStore{
+		queue:      queue,
+		owner:      owner,
+		accounts:   accounts,
+		visibility: visibility,
+		retryDelay: retryDelay,
+	}
+}
+
+func newJobRecord(queue string, jb Job, status string) *mongodb.CollectionJobs {
+	var now = time.Now()
+	var state = jb.state()
+
+	return &mongodb.CollectionJobs{
+		ID:          state.id,
+		Queue:       queue,
+		Type:        jb.Type(),
+		Key:         jb.Key(),
+		Description: jb.String(),
+		Payload:     jb.payload(),
+		Status:      status,
+		Attempts:    int(state.failedCount),
+		Errors:      state.attempts,
+		VisibleAt:   now,
+		CreatedAt:   state.created,
+		UpdatedAt:   now,
+	}
+}
+
+// buryJob saves the exhausted job of the in-memory queue to the dead letters collection
+func buryJob(ctx context.Context, queue string, jb Job) error {
+	var record interface{} = newJobRecord(queue, jb, jobRecordDead)
+	return gMongoDB.InsertOne(ctx, "jobs_dead", &record)
+}
+
+func (m *mongoJobStore) push(ctx context.Context, jb Job) (e error) {
+	var record interface{} = newJobRecord(m.queue, jb, jobRecordReady)
+	return gMongoDB.InsertOne(ctx, "jobs", &record)
+}
+
+func (m *mongoJobStore) lease(ctx context.Context) (jb Job, e error) {
+	var now = time.Now()
+	var record = new(mongodb.CollectionJobs)
+
+	if e = gMongoDB.FindOneAndUpdate(ctx, "jobs", bson.M{
+		"queue": m.queue,
+		"$or": bson.A{
+			bson.M{"status": jobRecordReady, "visibleAt": bson.M{"$lte": now}},
+			bson.M{"status": jobRecordLeased, "leaseUntil": bson.M{"$lte": now}},
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"status":     jobRecordLeased,
+			"leasedBy":   m.owner,
+			"leaseUntil": now.Add(m.visibility),
+			"updatedAt":  now,
+		},
+	}, record, options.FindOneAndUpdate().SetSort(bson.M{"createdAt": 1}).SetReturnDocument(options.After)); e != nil {
+		if e == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, e
+	}
+
+	if jb, e = m.decode(record); e != nil {
+		gLogger.Error().Err(e).Str("job", record.ID).Str("type", record.Type).Msg("Could not decode leased job! Moving it to dead letters")
+		return nil, m.bury(ctx, record.ID, record.Attempts, e)
+	}
+
+	return jb, e
+}
+
+func (m *mongoJobStore) decode(record *mongodb.CollectionJobs) (jb Job, e error) {
+	var decoder, ok = jobDecoders[record.Type]
+	if !ok {
+		return nil, errors.New("Unknown job type " + record.Type)
+	}
+
+	var raw []byte
+	if raw, e = bson.Marshal(record.Payload); e != nil {
+		return nil, e
+	}
+
+	if jb, e = decoder(m.accounts, raw); e != nil {
+		return nil, e
+	}
+
+	var state = jb.state()
+	state.id = record.ID
+	state.status = jobStatusCreated
+	state.failedCount = uint8(record.Attempts)
+	state.attempts = record.Errors
+	state.created = record.CreatedAt
+
+	return jb, e
+}
+
+func (m *mongoJobStore) ack(ctx context.Context, jb Job) error {
+	return gMongoDB.DeleteOne(ctx, "jobs", bson.M{"_id": jb.ID(), "leasedBy": m.owner})
+}
+
+func (m *mongoJobStore) release(ctx context.Context, jb Job) error {
+	return gMongoDB.UpdateOne(ctx, "jobs", bson.M{"_id": jb.ID(), "leasedBy": m.owner}, bson.M{
+		"$set": bson.M{
+			"status":    jobRecordReady,
+			"visibleAt": time.Now(),
+			"updatedAt": time.Now(),
+		},
+	})
+}
+
+func (m *mongoJobStore) fail(ctx context.Context, jb Job, e error, dead bool) error {
+	if dead {
+		return m.bury(ctx, jb.ID(), int(jb.state().failedCount), e)
+	}
+
+	return gMongoDB.UpdateOne(ctx, "jobs", bson.M{"_id": jb.ID(), "leasedBy": m.owner}, bson.M{
+		"$set": bson.M{
+			"status":    jobRecordReady,
+			"attempts":  jb.state().failedCount,
+			"visibleAt": time.Now().Add(m.retryDelay),
+			"updatedAt": time.Now(),
+		},
+		"$push": bson.M{
+			"errors": &mongodb.CollectionJobsError{
+				Attempt: int(jb.state().failedCount),
+				Error:   e.Error(),
+				Time:    time.Now(),
+			},
+		},
+	})
+}
+
+// bury moves the job record to the dead letters collection
+func (m *mongoJobStore) bury(ctx context.Context, id string, attempts int, jbErr error) (e error) {
+	var record = new(mongodb.CollectionJobs)
+	if e = gMongoDB.FindOneAndUpdate(ctx, "jobs", bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"status":    jobRecordDead,
+			"attempts":  attempts,
+			"updatedAt": time.Now(),
+		},
+		"$push": bson.M{
+			"errors": &mongodb.CollectionJobsError{
+				Attempt: attempts,
+				Error:   jbErr.Error(),
+				Time:    time.Now(),
+			},
+		},
+	}, record, options.FindOneAndUpdate().SetReturnDocument(options.After)); e != nil {
+		return e
+	}
+
+	var dead interface{} = record
+	if e = gMongoDB.InsertOne(ctx, "jobs_dead", &dead); e != nil {
+		return e
+	}
+
+	return gMongoDB.DeleteOne(ctx, "jobs", bson.M{"_id": id})
+}
+
+func (m *mongoJobStore) count(ctx context.Context) (int64, error) {
+	return gMongoDB.CountDocuments(ctx, "jobs", bson.M{"queue": m.queue})
+}
+
+func (m *mongoJobStore) has(ctx context.Context, jobType, key string) (ok bool, e error) {
+	var count int64
+	if count, e = gMongoDB.CountDocuments(ctx, "jobs", bson.M{"queue": m.queue, "type": jobType, "key": key}); e != nil {
+		return false, e
+	}
+
+	return count != 0, e
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"context"
+	"time"
+)
+
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+// newRateLimiter allows rps API requests per second; zero rps disables limiting
+func newRateLimiter(rps int) *rateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		ticker: time.NewTicker(time.Second / time.Duration(rps)),
+	}
+}
+
+func (m *rateLimiter) wait(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.ticker.C:
+		return nil
+	}
+}
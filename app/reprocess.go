@@ -0,0 +1,198 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// messagePatch is the change of the stored message reported by the history page
+	messagePatch struct {
+		MsgId uint64 `bson:"msgId"`
+		Type  string `bson:"type"`
+	}
+
+	reprocessStats struct {
+		records, pages, skipped    int
+		messages, persons, patches int
+	}
+)
+
+func newPersons(persons []*getHistoryRspResultPerson, updatedAt time.Time) (result []*mongodb.CollectionPersons) {
+	for _, v := range persons {
+		if v != nil && v.Sn != "" {
+			result = append(result, newPerson(v, updatedAt))
+		}
+	}
+
+	return result
+}
+
+func newPatches(patches []*getHistoryRspResultPatch) (result []*messagePatch) {
+	for _, v := range patches {
+		if v != nil && v.MsgId != 0 && v.Type != "" {
+			result = append(result, &messagePatch{v.MsgId, v.Type})
+		}
+	}
+
+	return result
+}
+
+// patchModels mark stored messages with the type of their last patch, unknown messages are skipped
+func patchModels(chatId string, patches []*messagePatch) (models []mongo.WriteModel) {
+	for _, v := range patches {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"aimId": chatId, "messages.msgId": v.MsgId}).
+			SetUpdate(bson.M{"$set": bson.M{"messages.$.patch": v.Type}}))
+	}
+
+	return models
+}
+
+func personModels(persons []*mongodb.CollectionPersons) (models []mongo.WriteModel) {
+	for _, v := range persons {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"sn": v.Sn}).
+			SetUpdate(bson.M{"$set": v}).
+			SetUpsert(true))
+	}
+
+	return models
+}
+
+// messageModel replaces decoded fields of the stored message; the account and the patch are kept
+func messageModel(chatId string, message *mongodb.CollectionChatsMessage) mongo.WriteModel {
+	var set, unset = bson.M{
+		"messages.$.time":   message.Time,
+		"messages.$.wid":    message.Wid,
+		"messages.$.sender": message.Sender,
+		"messages.$.text":   message.Text,
+	}, bson.M{}
+
+	if len(message.Snippets) != 0 {
+		set["messages.$.snippets"] = message.Snippets
+	} else {
+		unset["messages.$.snippets"] = ""
+	}
+
+	if message.MemberEvent != nil {
+		set["messages.$.memberEvent"] = message.MemberEvent
+	} else {
+		unset["messages.$.memberEvent"] = ""
+	}
+
+	var update = bson.M{"$set": set}
+	if len(unset) != 0 {
+		update["$unset"] = unset
+	}
+
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"aimId": chatId, "messages.msgId": message.MsgId}).
+		SetUpdate(update)
+}
+
+// decodeCapturedHistory decodes the captured getHistory response as the dump does
+func decodeCapturedHistory(record *mongodb.CollectionRAPIRequests) (results *getHistoryRspResult, e error) {
+	if record.Error != "" {
+		return nil, errors.New(record.Error)
+	}
+
+	if e = newAPIError("getHistory", record.Account, record.Status, ""); e != nil {
+		return nil, e
+	}
+
+	var api = &ICQApi{account: record.Account}
+	var body = io.NopCloser(strings.NewReader(record.Body))
+
+	var rsp *getHistoryRsp
+	if rsp, e = api.getChatMessagesResponse(&body); e != nil {
+		return nil, e
+	}
+
+	return rsp.Results, e
+}
+
+// Reprocess runs the current getHistory decoder over responses captured to the source and updates
+// stored messages, persons and patches; messages which have not been stored are skipped
+func (m *App) Reprocess(w io.Writer, source string) (e error) {
+	if e = m.connectMongoDB(); e != nil {
+		return e
+	}
+	defer gMongoDB.Destruct()
+
+	var ctx = context.Background()
+
+	var records []*mongodb.CollectionRAPIRequests
+	if records, e = loadCapture(ctx, source); e != nil {
+		return e
+	}
+
+	var stats = new(reprocessStats)
+	for _, v := range records {
+		if v.Method != "getHistory" || v.Params == nil {
+			continue
+		}
+		stats.records++
+
+		var results *getHistoryRspResult
+		if results, e = decodeCapturedHistory(v); e != nil {
+			gLogger.Warn().Err(e).Str("reqId", v.ReqId).Str("chatId", chatRef{v.Account, v.Params.Sn}.String()).
+				Msg("Captured response is skipped")
+			stats.skipped++
+			continue
+		}
+
+		if e = reprocessPage(ctx, v, results, stats); e != nil {
+			return e
+		}
+	}
+
+	gLogger.Info().Str("source", source).Int("pages", stats.pages).Int("messages", stats.messages).
+		Msg("Captured responses have been successfully reprocessed")
+
+	_, e = fmt.Fprintf(w, "%d captured getHistory responses: %d reprocessed, %d skipped\n%d messages, %d persons, %d patches\n",
+		stats.records, stats.pages, stats.skipped, stats.messages, stats.persons, stats.patches)
+	return e
+}
+
+// reprocessPage writes the decoded page; persons of the capture are stored with its time, so responses
+// are reprocessed in the capture order and the latest one wins
+func reprocessPage(ctx context.Context, record *mongodb.CollectionRAPIRequests, results *getHistoryRspResult,
+	stats *reprocessStats) (e error) {
+
+	var models []mongo.WriteModel
+	for _, v := range results.Messages {
+		models = append(models, messageModel(record.Params.Sn, newChatMessage(v)))
+	}
+
+	var patches = newPatches(results.Patch)
+	models = append(models, patchModels(record.Params.Sn, patches)...)
+
+	if len(models) != 0 {
+		if _, e = gMongoDB.BulkWrite(ctx, "chats", models, options.BulkWrite().SetOrdered(true)); e != nil {
+			return e
+		}
+	}
+
+	var persons = newPersons(results.Persons, record.StartedAt)
+	if len(persons) != 0 {
+		if _, e = gMongoDB.BulkWrite(ctx, "persons", personModels(persons), options.BulkWrite().SetOrdered(false)); e != nil {
+			return e
+		}
+	}
+
+	stats.pages++
+	stats.messages += len(results.Messages)
+	stats.persons += len(persons)
+	stats.patches += len(patches)
+	return nil
+}
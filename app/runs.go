@@ -0,0 +1,194 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	uuid "github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	runStatusRunning     = "running"
+	runStatusFinished    = "finished"
+	runStatusInterrupted = "interrupted"
+	runStatusFailed      = "failed"
+)
+
+// runMaxErrors limits errors kept in the run record, the latest ones are kept
+const runMaxErrors = 100
+
+type (
+	// runReport is the record of one dump run in the runs collection
+	runReport struct {
+		sync.Mutex
+		record *mongodb.CollectionRuns
+	}
+)
+
+func newRunReport(params *AppParams, selector *ChatSelector) *runReport {
+	if selector == nil {
+		selector = new(ChatSelector)
+	}
+
+	var accounts []string
+	for _, v := range params.Accounts {
+		if v.Name != "" {
+			accounts = append(accounts, v.Name)
+		}
+	}
+
+	return &runReport{
+		record: &mongodb.CollectionRuns{
+			ID:        uuid.NewV4().String(),
+			Status:    runStatusRunning,
+			StartedAt: time.Now(),
+			Params: &mongodb.CollectionRunsParams{
+				Chats:       selector.Include,
+				Exclude:     selector.Exclude,
+				Queue:       params.QueueBackend,
+				Workers:     params.Workers,
+				Autoscale:   params.Autoscale,
+				Restart:     params.Restart,
+				Attachments: params.AttachmentsDir,
+				WriteBatch:  params.WriteBatch,
+				Accounts:    accounts,
+			},
+		},
+	}
+}
+
+func (m *runReport) start(ctx context.Context) error {
+	var record interface{} = m.record
+	if e := gMongoDB.InsertOne(ctx, "runs", &record); e != nil {
+		return e
+	}
+
+	gLogger.Info().Str("run", m.record.ID).Msg("Run has been successfully started")
+	return nil
+}
+
+// error adds the error to the run record; job is empty for application errors
+func (m *runReport) error(job string, e error) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.record.Errors = append(m.record.Errors, mongodb.CollectionRunsError{
+		Time:  time.Now(),
+		Job:   job,
+		Error: e.Error(),
+	})
+
+	if len(m.record.Errors) > runMaxErrors {
+		m.record.Errors = m.record.Errors[len(m.record.Errors)-runMaxErrors:]
+	}
+}
+
+func (m *runReport) finish(ctx context.Context, status string, snap *progressSnapshot) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.record.Status = status
+	m.record.FinishedAt = time.Now()
+	m.record.ChatsAttempted = snap.ChatsQueued
+	m.record.ChatsDone = snap.ChatsDone
+	m.record.MessagesFetched = snap.MessagesFetched
+	m.record.MessagesSaved = snap.MessagesSaved
+	m.record.JobsFailed = snap.JobsFailed
+	m.record.Chats = gCheckpoints.runChats()
+
+	if e := gMongoDB.UpdateOne(ctx, "runs", bson.M{"_id": m.record.ID}, bson.M{"$set": m.record}); e != nil {
+		return e
+	}
+
+	gLogger.Info().Str("run", m.record.ID).Str("status", status).Msg("Run report has been successfully saved")
+	return nil
+}
+
+func (m *App) ListRuns(w io.Writer, limit int64) (e error) {
+	if e = m.connectMongoDB(); e != nil {
+		return e
+	}
+	defer gMongoDB.Destruct()
+
+	var runs []*mongodb.CollectionRuns
+	if e = gMongoDB.Find(context.Background(), "runs", bson.M{}, &runs, options.Find().
+		SetSort(bson.M{"startedAt": -1}).SetLimit(limit).SetProjection(bson.M{"chats": 0, "errors": 0})); e != nil {
+		return e
+	}
+
+	var tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tSTARTED\tDURATION\tSELECTED\tCHATS\tMESSAGES\tFAILED JOBS")
+	for _, v := range runs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d / %d\t%d\t%d\n", v.ID, v.Status,
+			v.StartedAt.Local().Format("2006-01-02 15:04:05"), runDuration(v), strings.Join(v.Params.Chats, ","),
+			v.ChatsDone, v.ChatsAttempted, v.MessagesSaved, v.JobsFailed)
+	}
+
+	return tw.Flush()
+}
+
+func (m *App) ShowRun(w io.Writer, id string) (e error) {
+	if e = m.connectMongoDB(); e != nil {
+		return e
+	}
+	defer gMongoDB.Destruct()
+
+	var run = new(mongodb.CollectionRuns)
+	if e = gMongoDB.FindOne(context.Background(), "runs", bson.M{"_id": id}, run); e != nil {
+		return e
+	}
+
+	fmt.Fprintf(w, "Run:        %s\n", run.ID)
+	fmt.Fprintf(w, "Status:     %s\n", run.Status)
+	fmt.Fprintf(w, "Started:    %s\n", run.StartedAt.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "Duration:   %s\n", runDuration(run))
+	fmt.Fprintf(w, "Parameters: chats %q, exclude %q, queue %s, workers %d, autoscale %t, restart %t, write batch %d, attachments %q\n",
+		run.Params.Chats, run.Params.Exclude, run.Params.Queue, run.Params.Workers, run.Params.Autoscale, run.Params.Restart,
+		run.Params.WriteBatch, run.Params.Attachments)
+	if len(run.Params.Accounts) != 0 {
+		fmt.Fprintf(w, "Accounts:   %s\n", strings.Join(run.Params.Accounts, ", "))
+	}
+	fmt.Fprintf(w, "Chats:      %d / %d\n", run.ChatsDone, run.ChatsAttempted)
+	fmt.Fprintf(w, "Messages:   fetched %d, saved %d\n", run.MessagesFetched, run.MessagesSaved)
+	fmt.Fprintf(w, "Failed:     %d jobs\n\n", run.JobsFailed)
+
+	var tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHAT\tACCOUNT\tFETCHED\tSAVED\tCHECKPOINT\tCOMPLETED")
+	for _, v := range run.Chats {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%t\n", v.AimId, v.Account, v.MessagesFetched, v.MessagesSaved, v.Checkpoint, v.Completed)
+	}
+	if e = tw.Flush(); e != nil {
+		return e
+	}
+
+	if len(run.Errors) == 0 {
+		return e
+	}
+
+	fmt.Fprintln(w, "\nErrors:")
+	for _, v := range run.Errors {
+		fmt.Fprintf(w, "[%s] %s %s\n", v.Time.Local().Format("2006-01-02 15:04:05"), v.Job, v.Error)
+	}
+
+	return e
+}
+
+func runDuration(run *mongodb.CollectionRuns) time.Duration {
+	if run.Status == runStatusRunning {
+		return time.Since(run.StartedAt).Truncate(time.Second)
+	}
+
+	return run.FinishedAt.Sub(run.StartedAt).Truncate(time.Second)
+}
@@ -0,0 +1,208 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// chatSpans holds a span per chat dump, pages and writes of the chat are its children
+	chatSpans struct {
+		sync.Mutex
+		spans map[chatRef]trace.Span
+	}
+	// fileSpanExporter writes finished spans to the file as JSON lines
+	fileSpanExporter struct {
+		sync.Mutex
+		fd  *os.File
+		enc *json.Encoder
+	}
+	fileSpan struct {
+		Name         string            `json:"name"`
+		TraceId      string            `json:"traceId"`
+		SpanId       string            `json:"spanId"`
+		ParentSpanId string            `json:"parentSpanId,omitempty"`
+		Start        time.Time         `json:"start"`
+		End          time.Time         `json:"end"`
+		Duration     string            `json:"duration"`
+		Status       string            `json:"status"`
+		Error        string            `json:"error,omitempty"`
+		Attributes   map[string]string `json:"attributes,omitempty"`
+	}
+)
+
+func newTracerProvider(ctx context.Context, otlpEndpoint string, otlpInsecure bool, file string) (tp *sdktrace.TracerProvider, e error) {
+	var opts = []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "icqdumper"))),
+	}
+
+	if otlpEndpoint != "" {
+		var clientOpts = []otlptracehttp.Option{otlptracehttp.WithEndpoint(otlpEndpoint)}
+		if otlpInsecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+
+		var exporter sdktrace.SpanExporter
+		if exporter, e = otlptracehttp.New(ctx, clientOpts...); e != nil {
+			return nil, e
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	if file != "" {
+		var exporter *fileSpanExporter
+		if exporter, e = newFileSpanExporter(file); e != nil {
+			return nil, e
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(opts...), e
+}
+
+func newChatSpans() *chatSpans {
+	return &chatSpans{
+		spans: make(map[chatRef]trace.Span),
+	}
+}
+
+// context returns ctx with the chat span, the span is started on the first call
+func (m *chatSpans) context(ctx context.Context, chat chatRef, fromMsgId uint64) context.Context {
+	m.Lock()
+	defer m.Unlock()
+
+	var span, ok = m.spans[chat]
+	if !ok {
+		_, span = gTracer.Start(context.Background(), "chat",
+			trace.WithAttributes(attribute.String("aimId", chat.chatId), attribute.String("account", chat.account),
+				attribute.Int64("fromMsgId", int64(fromMsgId))))
+		m.spans[chat] = span
+	}
+
+	return trace.ContextWithSpan(ctx, span)
+}
+
+// lookup returns ctx with the chat span if the chat dump is in progress
+func (m *chatSpans) lookup(ctx context.Context, chat chatRef) context.Context {
+	m.Lock()
+	defer m.Unlock()
+
+	if span, ok := m.spans[chat]; ok {
+		return trace.ContextWithSpan(ctx, span)
+	}
+
+	return ctx
+}
+
+func (m *chatSpans) end(chat chatRef) {
+	m.Lock()
+	defer m.Unlock()
+
+	if span, ok := m.spans[chat]; ok {
+		span.End()
+		delete(m.spans, chat)
+	}
+}
+
+// endAll ends spans of chats that have not been dumped completely
+func (m *chatSpans) endAll() {
+	m.Lock()
+	defer m.Unlock()
+
+	for chat, span := range m.spans {
+		span.SetStatus(codes.Error, "chat dump has been interrupted")
+		span.End()
+		delete(m.spans, chat)
+	}
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return gTracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, e error) {
+	if e != nil {
+		span.RecordError(e)
+		span.SetStatus(codes.Error, e.Error())
+	}
+	span.End()
+}
+
+func (m *App) shutdownTracing(tp *sdktrace.TracerProvider) {
+	gChatSpans.endAll()
+
+	var ctx, cncl = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+
+	if e := tp.Shutdown(ctx); e != nil {
+		gLogger.Warn().Err(e).Msg("Could not flush traces")
+	}
+}
+
+func newFileSpanExporter(file string) (exporter *fileSpanExporter, e error) {
+	var fd *os.File
+	if fd, e = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); e != nil {
+		return nil, e
+	}
+
+	return &fileSpanExporter{
+		fd:  fd,
+		enc: json.NewEncoder(fd),
+	}, e
+}
+
+func (m *fileSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) (e error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, v := range spans {
+		var span = &fileSpan{
+			Name:     v.Name(),
+			TraceId:  v.SpanContext().TraceID().String(),
+			SpanId:   v.SpanContext().SpanID().String(),
+			Start:    v.StartTime(),
+			End:      v.EndTime(),
+			Duration: v.EndTime().Sub(v.StartTime()).String(),
+			Status:   v.Status().Code.String(),
+			Error:    v.Status().Description,
+		}
+
+		if v.Parent().IsValid() {
+			span.ParentSpanId = v.Parent().SpanID().String()
+		}
+
+		if len(v.Attributes()) != 0 {
+			span.Attributes = make(map[string]string, len(v.Attributes()))
+			for _, attr := range v.Attributes() {
+				span.Attributes[string(attr.Key)] = attr.Value.Emit()
+			}
+		}
+
+		if e = m.enc.Encode(span); e != nil {
+			return e
+		}
+	}
+
+	return e
+}
+
+func (m *fileSpanExporter) Shutdown(ctx context.Context) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if e := m.fd.Sync(); e != nil {
+		return e
+	}
+
+	return m.fd.Close()
+}
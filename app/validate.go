@@ -0,0 +1,147 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	// responseValidator is implemented by decoded API responses; decoders validate responses
+	// before they are used, so handlers do not dereference missing fields
+	responseValidator interface {
+		validate() error
+	}
+
+	// validationError reports the missing or invalid field of the decoded response
+	validationError struct {
+		response string
+		field    string
+		reason   string
+	}
+)
+
+var errValidation = errors.New("invalid ICQ API response")
+
+func newValidationError(response, field, reason string) error {
+	return &validationError{
+		response: response,
+		field:    field,
+		reason:   reason,
+	}
+}
+
+func (m *validationError) Error() string {
+	return fmt.Sprintf("%s %s: %s %s", errValidation, m.response, m.field, m.reason)
+}
+
+func (m *validationError) Unwrap() error { return errValidation }
+
+// validateResponse validates v if it is a responseValidator
+func validateResponse(v interface{}) error {
+	if validator, ok := v.(responseValidator); ok {
+		return validator.validate()
+	}
+
+	return nil
+}
+
+func (m *getHistoryRsp) validate() error {
+	if m == nil {
+		return newValidationError("getHistory", "response", "is empty")
+	}
+	if m.Results == nil {
+		return newValidationError("getHistory", "results", "are missing")
+	}
+
+	for i, v := range m.Results.Messages {
+		if v == nil {
+			return newValidationError("getHistory", fmt.Sprintf("messages[%d]", i), "is null")
+		}
+		if v.MsgId == 0 {
+			return newValidationError("getHistory", fmt.Sprintf("messages[%d].msgId", i), "is missing")
+		}
+	}
+
+	return nil
+}
+
+func (m *getBuddyListRsp) validate() error {
+	if m == nil || m.Response == nil {
+		return newValidationError("getBuddyList", "response", "is empty")
+	}
+	if m.Response.Data == nil {
+		return newValidationError("getBuddyList", "data", "is missing")
+	}
+
+	for i, group := range m.Response.Data.Groups {
+		if group == nil {
+			return newValidationError("getBuddyList", fmt.Sprintf("groups[%d]", i), "is null")
+		}
+
+		for j, buddy := range group.Buddies {
+			if buddy == nil || buddy.AimId == "" {
+				return newValidationError("getBuddyList", fmt.Sprintf("groups[%d].buddies[%d].aimId", i, j), "is missing")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *getChatInfoRsp) validate() error {
+	if m == nil {
+		return newValidationError("getChatInfo", "response", "is empty")
+	}
+	if m.Results == nil {
+		return newValidationError("getChatInfo", "results", "are missing")
+	}
+	if m.Results.Sn == "" {
+		return newValidationError("getChatInfo", "sn", "is missing")
+	}
+
+	return nil
+}
+
+func (m *getChatMembersRsp) validate() error {
+	if m == nil {
+		return newValidationError("getChatMembers", "response", "is empty")
+	}
+	if m.Results == nil {
+		return newValidationError("getChatMembers", "results", "are missing")
+	}
+
+	for i, v := range m.Results.Members {
+		if v == nil || v.Sn == "" {
+			return newValidationError("getChatMembers", fmt.Sprintf("members[%d].sn", i), "is missing")
+		}
+	}
+
+	return nil
+}
+
+func (m *wimClientLoginData) validate() error {
+	if m.Token == nil || m.Token.A == "" {
+		return newValidationError("login", "token.a", "is missing")
+	}
+	if m.SessionSecret == "" && m.SessionKey == "" {
+		return newValidationError("login", "sessionSecret", "and sessionKey are missing")
+	}
+
+	return nil
+}
+
+func (m *wimPhoneValidationData) validate() error {
+	if m.TransId == "" {
+		return newValidationError("requestPhoneValidation", "trans_id", "is missing")
+	}
+
+	return nil
+}
+
+func (m *wimStartSessionData) validate() error {
+	if m.AimSid == "" {
+		return newValidationError("startSession", "aimsid", "is missing")
+	}
+
+	return nil
+}
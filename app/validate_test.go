@@ -0,0 +1,105 @@
+package app
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"github.com/rs/zerolog"
+)
+
+// seedCapturedResponses adds bodies of the method from every capture file in testdata together with
+// truncated and empty payloads; files are read as --capture writes them, so redacted captures of real
+// runs are added as they are. synthetic_rapi_requests.jsonl.gz is hand-written in the capture format
+// and stays only until real captures of every method are added
+func seedCapturedResponses(f *testing.F, method string) {
+	var nop = zerolog.Nop()
+	gLogger = &nop
+
+	var files, e = filepath.Glob("testdata/*.jsonl.gz")
+	if e != nil {
+		f.Fatal(e)
+	}
+
+	var seeded int
+	for _, file := range files {
+		var records []*mongodb.CollectionRAPIRequests
+		if records, e = readCaptureFile(file); e != nil {
+			f.Fatal(e)
+		}
+
+		for _, record := range records {
+			if record.Method == method {
+				f.Add([]byte(record.Body))
+				f.Add([]byte(record.Body[:len(record.Body)/2]))
+				seeded++
+			}
+		}
+	}
+
+	if seeded == 0 {
+		f.Fatalf("no captured %s responses in testdata", method)
+	}
+
+	for _, v := range []string{"", "null", "{}", `{"results":null}`, `{"results":{"messages":[null]}}`} {
+		f.Add([]byte(v))
+	}
+}
+
+func fuzzBody(data []byte) *io.ReadCloser {
+	var body = io.NopCloser(strings.NewReader(string(data)))
+	return &body
+}
+
+// decoded responses are used as handlers use them, so the fuzzer finds fields they dereference without validation
+func FuzzGetChatMessagesResponse(f *testing.F) {
+	seedCapturedResponses(f, "getHistory")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var rsp, e = new(ICQApi).getChatMessagesResponse(fuzzBody(data))
+		if e != nil {
+			return
+		}
+
+		for _, v := range rsp.Results.Messages {
+			newChatMessage(v)
+		}
+		newPersons(rsp.Results.Persons, time.Now())
+		newPatches(rsp.Results.Patch)
+	})
+}
+
+func FuzzGetChatInfoResponse(f *testing.F) {
+	seedCapturedResponses(f, "getChatInfo")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var api = new(ICQApi)
+
+		var rsp, e = api.getChatInfoResponse(fuzzBody(data))
+		if e != nil {
+			return
+		}
+
+		api.newChatInfo(rsp.Results)
+	})
+}
+
+func FuzzGetBuddyListResponse(f *testing.F) {
+	seedCapturedResponses(f, "getBuddyList")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var chats, e = new(ICQApi).getChatsResponse(fuzzBody(data))
+		if e != nil {
+			return
+		}
+
+		for _, v := range chats {
+			if v == nil || v.AimId == "" {
+				t.Fatalf("validated buddy list has the chat without aimId: %v", v)
+			}
+		}
+	})
+}
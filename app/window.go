@@ -0,0 +1,77 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// historyWindow bounds dumped messages by time, zero bounds are open;
+	// backward dumps page from the newest message down to since or the last messages count
+	historyWindow struct {
+		since, until time.Time
+		backward     bool
+		last         int
+	}
+)
+
+// ParseTimeBound parses an absolute date or a duration back from now, e.g. 2160h or 90d
+func ParseTimeBound(value string) (bound time.Time, e error) {
+	if value == "" {
+		return bound, nil
+	}
+
+	if strings.HasSuffix(value, "d") {
+		var days int
+		if days, e = strconv.Atoi(strings.TrimSuffix(value, "d")); e == nil {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+
+	var duration time.Duration
+	if duration, e = time.ParseDuration(value); e == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	if bound, e = time.Parse(time.RFC3339, value); e == nil {
+		return bound, nil
+	}
+
+	if bound, e = parseBrowseDate(value); e != nil {
+		return bound, errors.New("Could not parse time bound " + value + "! Use a date, RFC3339 time or duration")
+	}
+
+	return bound, e
+}
+
+func (m *historyWindow) bounded() bool {
+	return m != nil && (!m.since.IsZero() || !m.until.IsZero() || m.backward)
+}
+
+// filter returns page messages inside the window; done is set when the page has reached
+// the bound in the paging direction (until or since for backward) and the following pages are not needed
+func (m *historyWindow) filter(messages []*getHistoryRspResultMessage, backward bool) (filtered []*getHistoryRspResultMessage, done bool) {
+	if !m.bounded() {
+		return messages, false
+	}
+
+	for _, v := range messages {
+		var t = time.Unix(v.Time, 0)
+
+		if !m.until.IsZero() && t.After(m.until) {
+			done = done || !backward
+			continue
+		}
+
+		if !m.since.IsZero() && t.Before(m.since) {
+			done = done || backward
+			continue
+		}
+
+		filtered = append(filtered, v)
+	}
+
+	return filtered, done
+}
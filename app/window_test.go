@@ -0,0 +1,89 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeBound(t *testing.T) {
+	var now = time.Now()
+
+	var tests = []struct {
+		value string
+		want  time.Time
+		fails bool
+	}{
+		{"", time.Time{}, false},
+		{"90d", now.AddDate(0, 0, -90), false},
+		{"2160h", now.Add(-2160 * time.Hour), false},
+		{"30m", now.Add(-30 * time.Minute), false},
+		{"2022-03-01T10:00:00Z", time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC), false},
+		{"2022-03-01", time.Date(2022, 3, 1, 0, 0, 0, 0, time.Local), false},
+		{"2022-03-01 10:30", time.Date(2022, 3, 1, 10, 30, 0, 0, time.Local), false},
+		{"d", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+		{"2022-13-01", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var bound, e = ParseTimeBound(tt.value)
+			if tt.fails {
+				if e == nil {
+					t.Errorf("got bound %v, want error", bound)
+				}
+				return
+			}
+
+			if e != nil {
+				t.Fatal(e)
+			}
+			if d := bound.Sub(tt.want); d < -time.Second || d > time.Second {
+				t.Errorf("got bound %v, want %v", bound, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryWindowFilter(t *testing.T) {
+	var since, until = time.Unix(1000, 0), time.Unix(2000, 0)
+	var page = []*getHistoryRspResultMessage{
+		{MsgId: 1, Time: 500}, {MsgId: 2, Time: 1000}, {MsgId: 3, Time: 1500}, {MsgId: 4, Time: 2000}, {MsgId: 5, Time: 2500},
+	}
+
+	var tests = []struct {
+		name     string
+		window   *historyWindow
+		backward bool
+		msgIds   []uint64
+		done     bool
+	}{
+		{"unbounded", nil, false, []uint64{1, 2, 3, 4, 5}, false},
+		{"until only", &historyWindow{until: until}, false, []uint64{1, 2, 3, 4}, true},
+		{"since forward", &historyWindow{since: since}, false, []uint64{2, 3, 4, 5}, false},
+		{"since backward", &historyWindow{since: since, backward: true}, true, []uint64{2, 3, 4, 5}, true},
+		{"until backward", &historyWindow{until: until, backward: true}, true, []uint64{1, 2, 3, 4}, false},
+		{"since and until", &historyWindow{since: since, until: until}, false, []uint64{2, 3, 4}, true},
+		{"outside", &historyWindow{since: time.Unix(3000, 0)}, false, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filtered, done = tt.window.filter(page, tt.backward)
+
+			var msgIds []uint64
+			for _, v := range filtered {
+				msgIds = append(msgIds, v.MsgId)
+			}
+
+			if len(msgIds) != len(tt.msgIds) || done != tt.done {
+				t.Fatalf("got msgIds %v done %v, want %v done %v", msgIds, done, tt.msgIds, tt.done)
+			}
+			for i := range msgIds {
+				if msgIds[i] != tt.msgIds[i] {
+					t.Errorf("got msgIds %v, want %v", msgIds, tt.msgIds)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/MindHunter86/icqdumper/system/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// batchWriter writes history pages grouped by the ordered db dispatcher with one BulkWrite;
+	// pages of one chat come in the fetch order, so messages are pushed in msgId order
+	batchWriter struct {
+		backlog int64
+	}
+)
+
+func newBatchWriter(backlog int64) *batchWriter {
+	return &batchWriter{
+		backlog: backlog,
+	}
+}
+
+// throttle blocks fetchers while the db queue has more pending jobs than backlog
+func (m *batchWriter) throttle(ctx context.Context) error {
+	if m.backlog <= 0 || gDBQueue.getPending() < m.backlog {
+		return nil
+	}
+
+	gLogger.Debug().Int64("pending", gDBQueue.getPending()).Msg("DB queue is behind, fetching is paused")
+
+	var ticker = time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for gDBQueue.getPending() >= m.backlog {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// pushMessages pushes the page with one update; pages written from the newest message
+// keep the messages array sorted by msgId, so the array is sorted once per page
+func pushMessages(page *SaveMessages, messages bson.A) bson.M {
+	var push = bson.M{"$each": messages}
+	if page.Backward {
+		push["$sort"] = bson.M{"msgId": 1}
+	}
+
+	return bson.M{"$push": bson.M{"messages": push}}
+}
+
+// write is safe for pages written twice, already stored msgIds are skipped; every page update must
+// match its chat document, the checkpoint of the page is not advanced otherwise
+func (m *batchWriter) write(ctx context.Context, pages []*SaveMessages) (e error) {
+	var stored map[string]map[uint64]bool
+	if stored, e = storedMsgIds(ctx, pages); e != nil {
+		return e
+	}
+
+	var saved int
+	var models []mongo.WriteModel
+	for _, page := range pages {
+		var messages = make(bson.A, 0, len(page.Messages))
+		for _, v := range page.Messages {
+			if !stored[page.ChatId][v.MsgId] {
+				stored[page.ChatId][v.MsgId] = true
+				messages = append(messages, v)
+			}
+		}
+
+		if len(messages) == 0 {
+			continue
+		}
+
+		saved += len(messages)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"aimId": page.ChatId}).
+			SetUpdate(pushMessages(page, messages)))
+	}
+
+	// patches are written after the messages, so they apply to messages of the same batch too
+	var patches []mongo.WriteModel
+	var persons []*mongodb.CollectionPersons
+	for _, page := range pages {
+		patches = append(patches, patchModels(page.ChatId, page.Patches)...)
+		persons = append(persons, page.Persons...)
+	}
+
+	var spans = make([]trace.Span, 0, len(pages))
+	for _, page := range pages {
+		var _, span = startSpan(gChatSpans.lookup(ctx, page.ref()), "db.write",
+			attribute.String("aimId", page.ChatId), attribute.String("account", page.Account),
+			attribute.Int64("fromMsgId", int64(page.FromMsgId)), attribute.Int("messages", len(page.Messages)),
+			attribute.Int("batch.pages", len(pages)))
+		spans = append(spans, span)
+	}
+
+	if len(models) != 0 {
+		var res *mongo.BulkWriteResult
+		var started = time.Now()
+		res, e = gMongoDB.BulkWrite(ctx, "chats", models, options.BulkWrite().SetOrdered(true))
+		gMetrics.observeDBWrite("bulkWrite", started, e)
+
+		if e == nil && res.MatchedCount != int64(len(models)) {
+			e = fmt.Errorf("%d of %d pages have not been stored, their chat documents are missing",
+				int64(len(models))-res.MatchedCount, len(models))
+		}
+	}
+
+	if e == nil && len(patches) != 0 {
+		_, e = gMongoDB.BulkWrite(ctx, "chats", patches, options.BulkWrite().SetOrdered(true))
+	}
+
+	if e == nil && len(persons) != 0 {
+		_, e = gMongoDB.BulkWrite(ctx, "persons", personModels(persons), options.BulkWrite().SetOrdered(false))
+	}
+
+	for _, span := range spans {
+		endSpan(span, e)
+	}
+
+	if e != nil {
+		gLogger.Warn().Err(e).Int("pages", len(pages)).Int("messages", saved).Msg("Could not write messages batch")
+		return e
+	}
+
+	for _, page := range pages {
+		gCheckpoints.saved(page.ref(), page.FromMsgId, page.lastMsgId(), len(page.Messages))
+	}
+	atomic.AddInt64(&gProgress.messagesSaved, int64(saved))
+
+	return e
+}
+
+// storedMsgIds returns msgIds of the pages that are already in their chat documents; pages could
+// overlap stored messages, e.g. a full dump runs over messages stored by a bounded one
+func storedMsgIds(ctx context.Context, pages []*SaveMessages) (stored map[string]map[uint64]bool, e error) {
+	var msgIds = make(map[string]bson.A)
+	for _, page := range pages {
+		for _, v := range page.Messages {
+			msgIds[page.ChatId] = append(msgIds[page.ChatId], v.MsgId)
+		}
+	}
+
+	stored = make(map[string]map[uint64]bool, len(msgIds))
+	for aimId, ids := range msgIds {
+		var docs []struct {
+			MsgIds []uint64 `bson:"msgIds"`
+		}
+		if e = gMongoDB.Aggregate(ctx, "chats", mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"aimId": aimId}}},
+			{{Key: "$project", Value: bson.M{"msgIds": bson.M{"$setIntersection": bson.A{"$messages.msgId", ids}}}}},
+		}, &docs); e != nil {
+			return nil, e
+		}
+
+		stored[aimId] = make(map[uint64]bool)
+		for _, doc := range docs {
+			for _, v := range doc.MsgIds {
+				stored[aimId][v] = true
+			}
+		}
+	}
+
+	return stored, nil
+}
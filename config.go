@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// config file format:
+//
+//	default_profile: work
+//	profiles:
+//	  work:
+//	    aimsid: "..."
+//	    mongodb: mongodb://localhost:27017
+//	    workers: 64
+//	    rate-limit: 10
+//	    chat: [ "group:Work*" ]
+//	    exclude: [ "name:*flood*" ]
+//
+// profile keys are names of command flags; flags and env vars override file values
+type (
+	configFile struct {
+		DefaultProfile string                            `yaml:"default_profile"`
+		Profiles       map[string]map[string]interface{} `yaml:"profiles"`
+	}
+)
+
+const configRedacted = "<redacted>"
+
+var (
+	// flags which have no meaning in a config profile
+	configIgnoredFlags = map[string]bool{"config": true, "profile": true, "help": true, "password": true}
+	// flags holding secrets which are not printed by `config show`
+	configSecretFlags = map[string]bool{"aimsid": true, "password": true}
+)
+
+// defaultConfigPath returns the file path in the XDG config directory of icqdumper
+func defaultConfigPath(file string) string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); len(dir) != 0 {
+		return filepath.Join(dir, "icqdumper", file)
+	}
+
+	if home, e := os.UserHomeDir(); e == nil {
+		return filepath.Join(home, ".config", "icqdumper", file)
+	}
+
+	return ""
+}
+
+// loadConfig reads the config file given by --config or found in the default location;
+// a missing default file is not an error
+func loadConfig(c *cli.Context) (path string, cfg *configFile, e error) {
+	if path = c.String("config"); len(path) == 0 {
+		if path = defaultConfigPath("config.yaml"); len(path) == 0 {
+			return "", nil, nil
+		}
+
+		if _, e = os.Stat(path); os.IsNotExist(e) {
+			return "", nil, nil
+		}
+	}
+
+	var data []byte
+	if data, e = os.ReadFile(path); e != nil {
+		return "", nil, e
+	}
+
+	cfg = new(configFile)
+	if e = yaml.Unmarshal(data, cfg); e != nil {
+		return "", nil, errors.New("Could not parse config file " + path + "! " + e.Error())
+	}
+
+	return path, cfg, e
+}
+
+// profile returns the profile selected by --profile, default_profile or named "default"
+func (m *configFile) profile(name string) (string, map[string]interface{}, error) {
+	if len(name) == 0 {
+		if name = m.DefaultProfile; len(name) == 0 {
+			name = "default"
+			if _, ok := m.Profiles[name]; !ok {
+				return "", nil, nil
+			}
+		}
+	}
+
+	var profile, ok = m.Profiles[name]
+	if !ok {
+		return "", nil, errors.New("Profile " + name + " is not found in the config file!")
+	}
+
+	return name, profile, nil
+}
+
+// applyConfig sets flags of the command which are not given in args or env from the selected
+// profile; skip lists command flags which must not be taken from the profile
+func applyConfig(c *cli.Context, skip ...cli.Flag) (e error) {
+	var path string
+	var cfg *configFile
+	if path, cfg, e = loadConfig(c); e != nil || cfg == nil {
+		if e == nil && len(c.String("profile")) != 0 {
+			return errors.New("Profile " + c.String("profile") + " is given but config file is not found!")
+		}
+		return e
+	}
+
+	var name string
+	var profile map[string]interface{}
+	if name, profile, e = cfg.profile(c.String("profile")); e != nil || profile == nil {
+		return e
+	}
+
+	var known, own = flagNames(c.App.Commands), make(map[string]bool)
+	for _, f := range c.Command.Flags {
+		own[flagName(f)] = true
+	}
+	for _, f := range skip {
+		delete(own, flagName(f))
+	}
+
+	var keys = make([]string, 0, len(profile))
+	for k := range profile {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !known[k] || configIgnoredFlags[k] {
+			return errors.New("Unknown option " + k + " in profile " + name + " of " + path + "!")
+		}
+
+		if !own[k] || c.IsSet(k) {
+			continue
+		}
+
+		var values []interface{}
+		if list, ok := profile[k].([]interface{}); ok {
+			values = list
+		} else {
+			values = []interface{}{profile[k]}
+		}
+
+		for _, v := range values {
+			if e = c.Set(k, fmt.Sprint(v)); e != nil {
+				return errors.New("Invalid option " + k + " in profile " + name + "! " + e.Error())
+			}
+		}
+	}
+
+	log.Debug().Str("config", path).Str("profile", name).Msg("Config profile has been successfully applied")
+	return e
+}
+
+// showConfig prints the effective values of the command flags as a YAML profile
+func showConfig(w io.Writer, c *cli.Context) (e error) {
+	var effective = make(map[string]interface{})
+
+	for _, f := range c.Command.Flags {
+		var name = flagName(f)
+		if configIgnoredFlags[name] {
+			continue
+		}
+
+		switch f.(type) {
+		case cli.StringSliceFlag:
+			var values = make([]string, 0, len(c.StringSlice(name)))
+			for _, v := range c.StringSlice(name) {
+				values = append(values, redactConfigValue(name, v))
+			}
+			effective[name] = values
+		case cli.BoolFlag:
+			effective[name] = c.Bool(name)
+		case cli.IntFlag:
+			effective[name] = c.Int(name)
+		case cli.Int64Flag:
+			effective[name] = c.Int64(name)
+		case cli.DurationFlag:
+			effective[name] = c.Duration(name).String()
+		default:
+			effective[name] = redactConfigValue(name, c.String(name))
+		}
+	}
+
+	var path, profile = "-", "-"
+	if p, cfg, _ := loadConfig(c); cfg != nil {
+		path = p
+		if name, _, _ := cfg.profile(c.String("profile")); len(name) != 0 {
+			profile = name
+		}
+	}
+	fmt.Fprintf(w, "# config: %s\n# profile: %s\n", path, profile)
+
+	var data []byte
+	if data, e = yaml.Marshal(effective); e != nil {
+		return e
+	}
+
+	_, e = w.Write(data)
+	return e
+}
+
+func redactConfigValue(name, value string) string {
+	if len(value) == 0 {
+		return value
+	}
+
+	// accounts are given as <name>=<aimsid> or by name of the stored session
+	if name == "account" {
+		if key, _, ok := strings.Cut(value, "="); ok {
+			return key + "=" + configRedacted
+		}
+		return value
+	}
+
+	if configSecretFlags[name] {
+		return configRedacted
+	}
+
+	if uri, e := url.Parse(value); e == nil && uri.User != nil {
+		return uri.Redacted()
+	}
+
+	return value
+}
+
+func flagName(f cli.Flag) string {
+	return strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+}
+
+// flagNames collects flags of all commands and subcommands
+func flagNames(commands cli.Commands) map[string]bool {
+	var names = make(map[string]bool)
+	for _, cmd := range commands {
+		for _, f := range cmd.Flags {
+			names[flagName(f)] = true
+		}
+		for k := range flagNames(cmd.Subcommands) {
+			names[k] = true
+		}
+	}
+	return names
+}
+
+// allFlags returns flags of all commands and subcommands, the first flag wins for duplicated names
+func allFlags(commands cli.Commands, seen map[string]bool) (flags []cli.Flag) {
+	for _, cmd := range commands {
+		for _, f := range cmd.Flags {
+			if name := flagName(f); !seen[name] {
+				seen[name] = true
+				flags = append(flags, f)
+			}
+		}
+		flags = append(flags, allFlags(cmd.Subcommands, seen)...)
+	}
+	return flags
+}
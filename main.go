@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	application "github.com/MindHunter86/icqdumper/app"
 	"github.com/rs/zerolog"
+	"golang.org/x/term"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -37,6 +42,18 @@ func main() {
 
 	// define global flags:
 	var globAppFlags []cli.Flag = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			EnvVar: "ICQ_CONFIG",
+			Usage:  "Config file with settings profiles [$XDG_CONFIG_HOME/icqdumper/config.yaml]",
+		},
+		cli.StringFlag{
+			Name:   "profile, p",
+			Value:  "",
+			EnvVar: "ICQ_PROFILE",
+			Usage:  "Config profile name (default_profile of the config file if empty)",
+		},
 		cli.StringFlag{
 			Name:  "loglevel, l",
 			Value: "debug",
@@ -52,12 +69,43 @@ func main() {
 			EnvVar: "ICQ_AIMSID",
 			Usage:  "Bot or client AIMSID (megabot(70001) can help you)",
 		},
+		cli.StringSliceFlag{
+			Name:  "account",
+			Usage: "Named account as <name>=<aimsid> or <name> of the stored login session (may be repeated); chats and messages are tagged with the name",
+		},
+		cli.StringFlag{
+			Name:   "credentials",
+			Value:  "",
+			EnvVar: "ICQ_CREDENTIALS",
+			Usage:  "Login sessions file used if no AIMSID is given [$XDG_CONFIG_HOME/icqdumper/credentials.json]",
+		},
+		cli.StringFlag{
+			Name:  "auth-url",
+			Value: "https://api.icq.net",
+			Usage: "ICQ authentication API base URL",
+		},
+		cli.StringFlag{
+			Name:  "dev-id",
+			Value: "ic1rtwz1s1Hj1O0r",
+			Usage: "Developer key of the ICQ client used for the login",
+		},
 		cli.StringFlag{
 			Name:   "mongodb, m",
 			Value:  "",
 			EnvVar: "ICQ_MONGODB",
 			Usage:  "mongodb connection string",
 		},
+		cli.StringFlag{
+			Name:   "api-url",
+			Value:  "https://botapi.icq.net",
+			EnvVar: "ICQ_API_URL",
+			Usage:  "ICQ API base URL",
+		},
+		cli.IntFlag{
+			Name:  "rate-limit",
+			Value: 0,
+			Usage: "Max ICQ API requests per second (0 disables limiting)",
+		},
 		cli.IntFlag{
 			Name:  "workers",
 			Value: 128,
@@ -75,61 +123,463 @@ func main() {
 		},
 	}
 
+	// flags of commands running the dump pipeline:
+	var dumpFlags []cli.Flag = []cli.Flag{
+		cli.StringFlag{
+			Name:  "ui",
+			Value: defaultUIMode(),
+			Usage: "User interface mode (none, tui, plain); plain prints progress lines to stderr, it is the default if stdout is not a terminal",
+		},
+		cli.DurationFlag{
+			Name:  "progress-interval",
+			Value: 10 * time.Second,
+			Usage: "Progress report interval for plain UI mode",
+		},
+		cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Value: 30 * time.Second,
+			Usage: "Time for flushing pending DB jobs on shutdown",
+		},
+		cli.BoolFlag{
+			Name:  "restart",
+			Usage: "Ignore saved checkpoints and dump chats from the first message",
+		},
+		cli.StringFlag{
+			Name:  "attachments",
+			Value: "",
+			Usage: "Directory for downloading files linked from messages (disabled if empty)",
+		},
+		cli.DurationFlag{
+			Name:  "queue-visibility",
+			Value: 5 * time.Minute,
+			Usage: "Lease time of a persistent queue job before it is redelivered",
+		},
+		cli.DurationFlag{
+			Name:  "queue-retry-delay",
+			Value: 10 * time.Second,
+			Usage: "Delay before a failed queue job is retried, it grows with every failure of the job",
+		},
+		cli.IntFlag{
+			Name:  "write-batch",
+			Value: 500,
+			Usage: "Number of chat messages written to MongoDB with one bulk write",
+		},
+		cli.DurationFlag{
+			Name:  "write-flush-interval",
+			Value: time.Second,
+			Usage: "Max time messages wait in an incomplete write batch",
+		},
+		cli.Int64Flag{
+			Name:  "write-backlog",
+			Value: 1000,
+			Usage: "Pending DB jobs count pausing history fetching (0 disables)",
+		},
+		cli.BoolFlag{
+			Name:  "autoscale",
+			Usage: "Resize chat workers pool by queue depth, latency and error rate (--workers is the initial size)",
+		},
+		cli.IntFlag{
+			Name:  "workers-min",
+			Value: 8,
+			Usage: "Minimal chat workers count in autoscale mode",
+		},
+		cli.IntFlag{
+			Name:  "workers-max",
+			Value: 512,
+			Usage: "Maximal chat workers count in autoscale mode",
+		},
+		cli.DurationFlag{
+			Name:  "autoscale-interval",
+			Value: 5 * time.Second,
+			Usage: "Interval between worker pool resizing decisions",
+		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Value: "",
+			Usage: "Address for the Prometheus metrics endpoint, e.g. :9090 (disabled if empty)",
+		},
+		cli.StringFlag{
+			Name:  "trace-otlp",
+			Value: "",
+			Usage: "OTLP/HTTP collector address for tracing, e.g. localhost:4318 (disabled if empty)",
+		},
+		cli.BoolFlag{
+			Name:  "trace-otlp-insecure",
+			Usage: "Send traces to the OTLP collector over plain HTTP",
+		},
+		cli.StringFlag{
+			Name:  "trace-file",
+			Value: "",
+			Usage: "File for writing traces as JSON lines (disabled if empty)",
+		},
+	}
+
+	// flags of raw API capture and replay:
+	var captureFlags []cli.Flag = []cli.Flag{
+		cli.StringFlag{
+			Name:  "capture",
+			Value: "",
+			Usage: "Capture raw API requests and responses to mongodb (rapi_requests collection) or to the gzipped JSON lines file (disabled if empty)",
+		},
+		cli.StringFlag{
+			Name:  "replay",
+			Value: "",
+			Usage: "Serve API responses from the capture in mongodb or in the file instead of the network (disabled if empty)",
+		},
+	}
+
+	// flags of dead letters commands:
+	var failedFlags []cli.Flag = []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "id",
+			Usage: "Failed job ID (may be repeated)",
+		},
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "Filter failed jobs by type (FetchChatPage, SaveMessages, DownloadAttachment)",
+		},
+		cli.StringFlag{
+			Name:  "queue",
+			Usage: "Filter failed jobs by queue (chats, db)",
+		},
+	}
+
+	// flags of chat selection:
+	var chatFlags []cli.Flag = []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "chat, c",
+			Usage: "Chats for history dumping (may be repeated): all, <aimId>, group:<glob>, name:<glob>, re:<regexp> [all]",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude, x",
+			Usage: "Chats excluded from dumping (may be repeated), same values as --chat",
+		},
+	}
+
+	// flags of time-bounded dumps:
+	var windowFlags []cli.Flag = []cli.Flag{
+		cli.StringFlag{
+			Name:  "since",
+			Value: "",
+			Usage: "Dump messages not older than the date (2006-01-02[ 15:04[:05]], RFC3339) or duration back from now (2160h, 90d)",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Value: "",
+			Usage: "Dump messages not newer than the date or duration back from now; checkpoints are not saved for bounded dumps",
+		},
+		cli.BoolFlag{
+			Name:  "backward",
+			Usage: "Page history from the newest message to the oldest one (implied by --since and --last)",
+		},
+		cli.IntFlag{
+			Name:  "last",
+			Value: 0,
+			Usage: "Dump only the given number of the newest messages of every chat (0 disables)",
+		},
+	}
+
 	// commands define:
 	app.Commands = []cli.Command{
 		{
 			Name:    "getHistory",
 			Aliases: []string{"gh"},
 			Usage:   "get chat history",
+			Flags: append(append(append(append(globAppFlags, chatFlags...), windowFlags...),
+				cli.StringFlag{
+					Name:  "queue",
+					Value: application.QueueBackendMemory,
+					Usage: "Job queue backend (memory, mongodb); mongodb queue survives restarts",
+				}), append(dumpFlags, captureFlags...)...),
+			Action: func(c *cli.Context) (e error) {
+
+				if e = applyConfig(c); e != nil {
+					return e
+				}
+
+				var selector = newChatSelector(c)
+				if e = selector.Validate(); e != nil {
+					return e
+				}
+
+				var params *application.AppParams
+				if params, e = newDumpParams(c, c.String("queue")); e != nil {
+					return e
+				}
+
+				if params.Since, e = application.ParseTimeBound(c.String("since")); e != nil {
+					return e
+				}
+				if params.Until, e = application.ParseTimeBound(c.String("until")); e != nil {
+					return e
+				}
+				if !params.Since.IsZero() && !params.Until.IsZero() && params.Until.Before(params.Since) {
+					return errors.New("Invalid time bounds! --until is before --since")
+				}
+
+				if params.Backward, params.Last = c.Bool("backward"), c.Int("last"); params.Last < 0 {
+					return errors.New("Invalid --last value! It must not be negative")
+				}
+
+				return application.NewApp(&log, params).Bootstrap(selector)
+			},
+		},
+		{
+			Name:  "login",
+			Usage: "log in with UIN and password or phone and SMS code and store the session for other commands",
+			Flags: append(globAppFlags,
+				cli.StringFlag{
+					Name:  "name",
+					Value: "",
+					Usage: "Account name of the stored session (the default account if empty)",
+				},
+				cli.StringFlag{
+					Name:  "uin",
+					Value: "",
+					Usage: "UIN or e-mail for the password login",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Value:  "",
+					EnvVar: "ICQ_PASSWORD",
+					Usage:  "Password for the password login (prompted without echo if empty); the flag and ICQ_PASSWORD are visible in the process list and the shell history, prefer the prompt",
+				},
+				cli.StringFlag{
+					Name:  "phone",
+					Value: "",
+					Usage: "Phone number for the SMS code login, the code is read from stdin",
+				},
+				cli.StringFlag{
+					Name:  "sms-url",
+					Value: "https://www.icq.com/smsreg",
+					Usage: "ICQ SMS login API base URL",
+				}),
+			Action: func(c *cli.Context) (e error) {
+
+				if e = applyConfig(c); e != nil {
+					return e
+				}
+
+				setLogLevel(c)
+
+				var params = &application.LoginParams{
+					Name:        c.String("name"),
+					Uin:         c.String("uin"),
+					Password:    c.String("password"),
+					Phone:       c.String("phone"),
+					AuthURL:     c.String("auth-url"),
+					SMSURL:      c.String("sms-url"),
+					DevId:       c.String("dev-id"),
+					Credentials: credentialsPath(c),
+				}
+
+				if len(params.Phone) == 0 && len(params.Uin) == 0 {
+					return errors.New("UIN or phone is required for the login!")
+				}
+
+				if len(params.Phone) == 0 && len(params.Password) == 0 {
+					if params.Password, e = readPassword(); e != nil {
+						return e
+					}
+				}
+
+				return application.NewApp(&log, &application.AppParams{
+					Silent: c.Bool("silent"),
+				}).Login(os.Stdin, os.Stderr, params)
+			},
+		},
+		{
+			Name:  "failed",
+			Usage: "inspect and replay jobs that have exceeded the retry limit",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "print failed jobs",
+					Flags: append(globAppFlags, failedFlags...),
+					Action: func(c *cli.Context) (e error) {
+
+						if e = applyConfig(c, failedFlags...); e != nil {
+							return e
+						}
+
+						var app *application.App
+						if app, e = newDBApp(c); e != nil {
+							return e
+						}
+
+						return app.ListFailed(os.Stdout, &application.DeadLetterFilter{
+							IDs:   c.StringSlice("id"),
+							Type:  c.String("type"),
+							Queue: c.String("queue"),
+						})
+					},
+				},
+				{
+					Name:  "retry",
+					Usage: "move failed jobs back to the persistent queue and process them",
+					Flags: append(append(append(globAppFlags, failedFlags...), cli.BoolFlag{
+						Name:  "all",
+						Usage: "Retry every failed job matching filters",
+					}), append(dumpFlags, captureFlags...)...),
+					Action: func(c *cli.Context) (e error) {
+
+						if e = applyConfig(c, failedFlags...); e != nil {
+							return e
+						}
+
+						var app *application.App
+						if app, e = newDumpApp(c, application.QueueBackendMongoDB); e != nil {
+							return e
+						}
+
+						return app.RetryFailed(&application.DeadLetterFilter{
+							IDs:   c.StringSlice("id"),
+							Type:  c.String("type"),
+							Queue: c.String("queue"),
+							All:   c.Bool("all"),
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:  "chats",
+			Usage: "inspect chats of the buddy list",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "print chats selected by --chat and --exclude",
+					Flags: append(append(globAppFlags, chatFlags...), captureFlags...),
+					Action: func(c *cli.Context) (e error) {
+
+						if e = applyConfig(c); e != nil {
+							return e
+						}
+
+						var accounts []*application.Account
+						if accounts, e = newAccounts(c); e != nil {
+							return e
+						}
+
+						var selector = newChatSelector(c)
+						if e = selector.Validate(); e != nil {
+							return e
+						}
+
+						setLogLevel(c)
+
+						var app *application.App = application.NewApp(&log, &application.AppParams{
+							Silent:    c.Bool("silent"),
+							APIUrl:    c.String("api-url"),
+							RateLimit: c.Int("rate-limit"),
+							Accounts:  accounts,
+							Capture:   c.String("capture"),
+							Replay:    c.String("replay"),
+						})
+
+						return app.ListChats(os.Stdout, selector)
+					},
+				},
+			},
+		},
+		{
+			Name:  "runs",
+			Usage: "inspect reports of getHistory runs",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "print latest runs",
+					Flags: append(globAppFlags, cli.Int64Flag{
+						Name:  "limit",
+						Value: 20,
+						Usage: "Number of printed runs",
+					}),
+					Action: func(c *cli.Context) (e error) {
+
+						if e = applyConfig(c); e != nil {
+							return e
+						}
+
+						var app *application.App
+						if app, e = newDBApp(c); e != nil {
+							return e
+						}
+
+						return app.ListRuns(os.Stdout, c.Int64("limit"))
+					},
+				},
+				{
+					Name:      "show",
+					Usage:     "print the run report with per-chat results and errors",
+					ArgsUsage: "<run id>",
+					Flags:     globAppFlags,
+					Action: func(c *cli.Context) (e error) {
+
+						if len(c.Args().First()) == 0 {
+							return errors.New("Run ID is not given!")
+						}
+
+						if e = applyConfig(c); e != nil {
+							return e
+						}
+
+						var app *application.App
+						if app, e = newDBApp(c); e != nil {
+							return e
+						}
+
+						return app.ShowRun(os.Stdout, c.Args().First())
+					},
+				},
+			},
+		},
+		{
+			Name:  "reprocess",
+			Usage: "decode captured getHistory responses again and update stored messages, persons and patches",
 			Flags: append(globAppFlags, cli.StringFlag{
-				Name:  "chat, c",
-				Value: "all",
-				Usage: "Chat for histroy dumping (default all)",
+				Name:  "source",
+				Value: application.CaptureMongoDB,
+				Usage: "Capture to reprocess: mongodb (rapi_requests collection) or the capture file",
 			}),
 			Action: func(c *cli.Context) (e error) {
 
-				log.Debug().Str("chat", c.String("chat")).Msg("Given ChatID")
-
-				if len(c.String("aimsid")) == 0 {
-					log.Info().Str("aimsid", c.String("aimsid")).Msg("Given AIMSID")
-					return errors.New("AIMSID is undefined!")
-				}
-
-				if len(c.String("mongodb")) == 0 {
-					return errors.New("MONGODB connection string is empty!")
-				}
-
-				if !c.Bool("silent") {
-					switch c.String("loglevel") {
-					case "off":
-						zerolog.SetGlobalLevel(zerolog.NoLevel)
-					case "debug":
-						zerolog.SetGlobalLevel(zerolog.DebugLevel)
-					case "info":
-						zerolog.SetGlobalLevel(zerolog.InfoLevel)
-					case "warn":
-						zerolog.SetGlobalLevel(zerolog.WarnLevel)
-					case "error":
-						zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-					case "fatal":
-						zerolog.SetGlobalLevel(zerolog.FatalLevel)
-					case "panic":
-						zerolog.SetGlobalLevel(zerolog.PanicLevel)
-					}
-				} else {
-					zerolog.SetGlobalLevel(zerolog.NoLevel)
+				if e = applyConfig(c); e != nil {
+					return e
 				}
 
-				var app *application.App = application.NewApp(&log, &application.AppParams{
-					Silent:         c.Bool("silent"),
-					AimSid:         c.String("aimsid"),
-					MongoConn:      c.String("mongodb"),
-					Workers:        c.Int("workers"),
-					QueueBuffer:    c.Int("queuebuffer"),
-					WorkerCapacity: c.Int("workercapacity"),
-				})
+				if len(c.String("source")) == 0 {
+					return errors.New("Capture source is empty!")
+				}
 
-				return app.Bootstrap(c.String("chat"))
+				var app *application.App
+				if app, e = newDBApp(c); e != nil {
+					return e
+				}
+
+				return app.Reprocess(os.Stdout, c.String("source"))
+			},
+		},
+		{
+			Name:    "browse",
+			Aliases: []string{"br"},
+			Usage:   "browse dumped chats in the terminal",
+			Flags: append(globAppFlags, cli.StringFlag{
+				Name:  "exportdir, e",
+				Value: ".",
+				Usage: "Directory for chat exports from the browser",
+			}),
+			Action: func(c *cli.Context) (e error) {
+
+				if e = applyConfig(c); e != nil {
+					return e
+				}
+
+				var app *application.App
+				if app, e = newDBApp(c); e != nil {
+					return e
+				}
+
+				return app.Browse(c.String("exportdir"))
 			},
 		},
 		{
@@ -156,6 +606,27 @@ func main() {
 		},
 	}
 
+	// config command accepts every configurable flag for printing the merged configuration:
+	app.Commands = append(app.Commands, cli.Command{
+		Name:  "config",
+		Usage: "inspect the configuration file",
+		Subcommands: []cli.Command{
+			{
+				Name:  "show",
+				Usage: "print the effective configuration merged from flags, env and the config profile",
+				Flags: allFlags(app.Commands, map[string]bool{"id": true, "type": true, "all": true, "limit": true}),
+				Action: func(c *cli.Context) (e error) {
+
+					if e = applyConfig(c); e != nil {
+						return e
+					}
+
+					return showConfig(os.Stdout, c)
+				},
+			},
+		},
+	})
+
 	// sort all falgs && cmds:
 	sort.Sort(cli.FlagsByName(app.Flags))
 	sort.Sort(cli.CommandsByName(app.Commands))
@@ -165,3 +636,217 @@ func main() {
 		log.Fatal().Err(e).Msg("Could not run the App!")
 	}
 }
+
+func setLogLevel(c *cli.Context) {
+	if c.Bool("silent") {
+		zerolog.SetGlobalLevel(zerolog.NoLevel)
+		return
+	}
+
+	switch c.String("loglevel") {
+	case "off":
+		zerolog.SetGlobalLevel(zerolog.NoLevel)
+	case "debug":
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	case "info":
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	case "warn":
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	case "error":
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	case "fatal":
+		zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	case "panic":
+		zerolog.SetGlobalLevel(zerolog.PanicLevel)
+	}
+}
+
+func newChatSelector(c *cli.Context) *application.ChatSelector {
+	var selector = &application.ChatSelector{
+		Include: c.StringSlice("chat"),
+		Exclude: c.StringSlice("exclude"),
+	}
+
+	if len(selector.Include) == 0 {
+		selector.Include = []string{"all"}
+	}
+
+	return selector
+}
+
+// newAccounts returns the default account of --aimsid and named accounts of --account;
+// accounts without aimsid and all stored sessions if no account is given come from the credentials file
+func newAccounts(c *cli.Context) (accounts []*application.Account, e error) {
+	if len(c.String("aimsid")) != 0 {
+		accounts = append(accounts, &application.Account{AimSid: c.String("aimsid")})
+	}
+
+	var names, stored = make(map[string]bool), []string{}
+	for _, v := range c.StringSlice("account") {
+		var name, aimsid, ok = strings.Cut(v, "=")
+		if name = strings.TrimSpace(name); len(name) == 0 || ok && len(aimsid) == 0 {
+			return nil, errors.New("Invalid account " + v + "! It must be given as <name>=<aimsid> or <name>")
+		}
+
+		if names[name] || strings.Contains(name, "/") {
+			return nil, errors.New("Invalid account name " + name + "! Names must be unique and have no slashes")
+		}
+		names[name] = true
+
+		if !ok {
+			stored = append(stored, name)
+			continue
+		}
+
+		accounts = append(accounts, &application.Account{Name: name, AimSid: aimsid})
+	}
+
+	if len(stored) == 0 && len(accounts) != 0 {
+		return accounts, e
+	}
+
+	// replayed responses do not need a session
+	if len(stored) == 0 && len(c.String("replay")) != 0 {
+		return []*application.Account{{}}, e
+	}
+
+	var sessions []*application.Account
+	if sessions, e = application.SessionAccounts(credentialsPath(c), c.String("auth-url"), c.String("dev-id"), stored...); e != nil {
+		return nil, e
+	}
+
+	if accounts = append(accounts, sessions...); len(accounts) == 0 {
+		return nil, errors.New("AIMSID is undefined! Give --aimsid or run the login command")
+	}
+
+	return accounts, e
+}
+
+func credentialsPath(c *cli.Context) string {
+	if len(c.String("credentials")) != 0 {
+		return c.String("credentials")
+	}
+
+	return defaultConfigPath("credentials.json")
+}
+
+// readPassword prompts for the password without echo, piped passwords are read as the first line of stdin
+func readPassword() (password string, e error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+
+	var fd = int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		var buf []byte
+		buf, e = term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(buf)), e
+	}
+
+	if password, e = bufio.NewReader(os.Stdin).ReadString('\n'); e != nil && e != io.EOF {
+		return "", e
+	}
+
+	return strings.TrimSpace(password), nil
+}
+
+// defaultUIMode keeps the terminal UI out of cron and systemd runs
+func defaultUIMode() string {
+	if fi, e := os.Stdout.Stat(); e == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return application.UIModeTUI
+	}
+
+	return application.UIModePlain
+}
+
+func newDBApp(c *cli.Context) (*application.App, error) {
+
+	if len(c.String("mongodb")) == 0 {
+		return nil, errors.New("MONGODB connection string is empty!")
+	}
+
+	setLogLevel(c)
+
+	return application.NewApp(&log, &application.AppParams{
+		Silent:    c.Bool("silent"),
+		MongoConn: c.String("mongodb"),
+	}), nil
+}
+
+func newDumpApp(c *cli.Context, queueBackend string) (*application.App, error) {
+	var params, e = newDumpParams(c, queueBackend)
+	if e != nil {
+		return nil, e
+	}
+
+	return application.NewApp(&log, params), nil
+}
+
+func newDumpParams(c *cli.Context, queueBackend string) (*application.AppParams, error) {
+
+	var accounts, e = newAccounts(c)
+	if e != nil {
+		return nil, e
+	}
+
+	if len(c.String("mongodb")) == 0 {
+		return nil, errors.New("MONGODB connection string is empty!")
+	}
+
+	switch queueBackend {
+	case application.QueueBackendMemory, application.QueueBackendMongoDB:
+	default:
+		return nil, errors.New("Unknown queue backend " + queueBackend + "!")
+	}
+
+	if c.Int("workers") < 1 {
+		return nil, errors.New("Invalid --workers value! It must be at least 1")
+	}
+
+	if c.Bool("autoscale") && (c.Int("workers-min") < 1 || c.Int("workers-min") > c.Int("workers-max")) {
+		return nil, errors.New("Invalid autoscale bounds! workers-min must be in 1..workers-max")
+	}
+
+	if c.Int("rate-limit") < 0 {
+		return nil, errors.New("Invalid --rate-limit value! It must not be negative")
+	}
+
+	switch c.String("ui") {
+	case application.UIModeNone, application.UIModeTUI, application.UIModePlain:
+	default:
+		return nil, errors.New("Unknown UI mode " + c.String("ui") + "!")
+	}
+
+	setLogLevel(c)
+
+	return &application.AppParams{
+		UI:                 c.String("ui"),
+		ProgressInterval:   c.Duration("progress-interval"),
+		ShutdownTimeout:    c.Duration("shutdown-timeout"),
+		Restart:            c.Bool("restart"),
+		AttachmentsDir:     c.String("attachments"),
+		QueueBackend:       queueBackend,
+		QueueVisibility:    c.Duration("queue-visibility"),
+		QueueRetryDelay:    c.Duration("queue-retry-delay"),
+		WriteBatch:         c.Int("write-batch"),
+		WriteFlushInterval: c.Duration("write-flush-interval"),
+		WriteBacklog:       c.Int64("write-backlog"),
+		Silent:             c.Bool("silent"),
+		MongoConn:          c.String("mongodb"),
+		Workers:            c.Int("workers"),
+		QueueBuffer:        c.Int("queuebuffer"),
+		WorkerCapacity:     c.Int("workercapacity"),
+		Autoscale:          c.Bool("autoscale"),
+		WorkersMin:         c.Int("workers-min"),
+		WorkersMax:         c.Int("workers-max"),
+		AutoscaleInterval:  c.Duration("autoscale-interval"),
+		MetricsListen:      c.String("metrics-listen"),
+		TraceOTLPEndpoint:  c.String("trace-otlp"),
+		TraceOTLPInsecure:  c.Bool("trace-otlp-insecure"),
+		TraceFile:          c.String("trace-file"),
+		APIUrl:             c.String("api-url"),
+		RateLimit:          c.Int("rate-limit"),
+		Accounts:           accounts,
+		Capture:            c.String("capture"),
+		Replay:             c.String("replay"),
+	}, nil
+}
@@ -28,29 +28,203 @@ type (
 		ID       primitive.ObjectID       `bson:"_id"`
 		Name     string                   `bson:"name"`
 		AimId    string                   `bson:"aimId"`
+		Groups   []string                 `bson:"groups,omitempty"`
+		UserType string                   `bson:"userType,omitempty"`
+		Accounts []string                 `bson:"accounts,omitempty"`
 		Messages []CollectionChatsMessage `bson:"messages,omitempty"`
+
+		Info        *CollectionChatsInfo        `bson:"info,omitempty"`
+		InfoHistory []CollectionChatsInfoChange `bson:"infoHistory,omitempty"`
+	}
+	// CollectionChatsInfo is the group chat metadata of the chat info API
+	CollectionChatsInfo struct {
+		Name         string    `bson:"name"`
+		About        string    `bson:"about,omitempty"`
+		Rules        string    `bson:"rules,omitempty"`
+		Creator      string    `bson:"creator,omitempty"`
+		Admins       []string  `bson:"admins,omitempty"`
+		MembersCount int       `bson:"membersCount"`
+		Public       bool      `bson:"public"`
+		InviteLink   string    `bson:"inviteLink,omitempty"`
+		AvatarUrl    string    `bson:"avatarUrl,omitempty"`
+		AvatarFile   string    `bson:"avatarFile,omitempty"`
+		UpdatedAt    time.Time `bson:"updatedAt"`
+	}
+	// CollectionChatsInfoChange keeps the info replaced by the run with names of changed fields
+	CollectionChatsInfoChange struct {
+		ChangedAt time.Time            `bson:"changedAt"`
+		Fields    []string             `bson:"fields"`
+		Previous  *CollectionChatsInfo `bson:"previous"`
 	}
 	CollectionChatsMessage struct {
-		MsgId  uint64    `bson:"msgId"`
-		Time   time.Time `bson:"time"`
-		Wid    string    `bson:"wid"`
-		Sender string    `bson:"sender"`
-		Text   string    `bson:"text"`
+		MsgId   uint64    `bson:"msgId"`
+		Time    time.Time `bson:"time"`
+		Wid     string    `bson:"wid"`
+		Sender  string    `bson:"sender"`
+		Text    string    `bson:"text"`
+		Account string    `bson:"account,omitempty"`
+
+		Snippets    []*CollectionChatsSnippet   `bson:"snippets,omitempty"`
+		MemberEvent *CollectionChatsMemberEvent `bson:"memberEvent,omitempty"`
+		// Patch is the type of the last patch of the message, e.g. "delete" or "modify"
+		Patch string `bson:"patch,omitempty"`
+	}
+	CollectionChatsSnippet struct {
+		Type        string `bson:"type,omitempty"`
+		Url         string `bson:"url"`
+		ContentType string `bson:"contentType,omitempty"`
+		Title       string `bson:"title,omitempty"`
+		Description string `bson:"description,omitempty"`
+	}
+	CollectionChatsMemberEvent struct {
+		Type    string   `bson:"type"`
+		Role    string   `bson:"role,omitempty"`
+		Members []string `bson:"members,omitempty"`
 	}
 
+	// CollectionPersons are users met in chat histories, they are upserted by sn
+	CollectionPersons struct {
+		Sn        string    `bson:"sn"`
+		Friendly  string    `bson:"friendly,omitempty"`
+		FirstName string    `bson:"firstName,omitempty"`
+		LastName  string    `bson:"lastName,omitempty"`
+		Nick      string    `bson:"nick,omitempty"`
+		UpdatedAt time.Time `bson:"updatedAt"`
+	}
+
+	// CollectionRAPIRequests is the captured API request with its raw response
 	CollectionRAPIRequests struct {
-		Method string                        `bson:"method"`
-		ReqId  string                        `bson:"reqId"`
-		Params *CollectionRAPIRequestsParams `bson:"params"`
+		Method    string                        `bson:"method" json:"method"`
+		ReqId     string                        `bson:"reqId" json:"reqId"`
+		Account   string                        `bson:"account,omitempty" json:"account,omitempty"`
+		Params    *CollectionRAPIRequestsParams `bson:"params,omitempty" json:"params,omitempty"`
+		Status    int                           `bson:"status" json:"status"`
+		Body      string                        `bson:"body" json:"body"`
+		Error     string                        `bson:"error,omitempty" json:"error,omitempty"`
+		StartedAt time.Time                     `bson:"startedAt" json:"startedAt"`
+		Duration  time.Duration                 `bson:"duration" json:"duration"`
 	}
 	CollectionRAPIRequestsParams struct {
-		Sn           string `bson:"sn"`
-		FromMsgId    uint64 `bson:"fromMsgId"`
-		Count        int    `bson:"count"`
-		PatchVersion string `bson:"patchVersion"`
+		Sn           string `bson:"sn" json:"sn"`
+		FromMsgId    int64  `bson:"fromMsgId" json:"fromMsgId"`
+		Count        int    `bson:"count" json:"count"`
+		PatchVersion string `bson:"patchVersion" json:"patchVersion"`
+		Cursor       string `bson:"cursor,omitempty" json:"cursor,omitempty"`
+	}
+
+	// CollectionChatMembers is the membership of the group chat; RemovedAt is set for members
+	// missing in the latest snapshot
+	CollectionChatMembers struct {
+		ChatId    string     `bson:"chatId"`
+		Sn        string     `bson:"sn"`
+		Role      string     `bson:"role"`
+		JoinedAt  *time.Time `bson:"joinedAt,omitempty"`
+		Inviter   string     `bson:"inviter,omitempty"`
+		FirstSeen *time.Time `bson:"firstSeen,omitempty"`
+		LastSeen  time.Time  `bson:"lastSeen"`
+		RemovedAt *time.Time `bson:"removedAt,omitempty"`
+	}
+	// CollectionChatMembersChanges records members added, removed or given another role between runs
+	CollectionChatMembersChanges struct {
+		ChatId       string    `bson:"chatId"`
+		Sn           string    `bson:"sn"`
+		Change       string    `bson:"change"`
+		Role         string    `bson:"role,omitempty"`
+		PreviousRole string    `bson:"previousRole,omitempty"`
+		ChangedAt    time.Time `bson:"changedAt"`
+	}
+
+	// CollectionBuddySnapshots is the buddy list of the account taken by the run with changes
+	// since the previous snapshot of the account
+	CollectionBuddySnapshots struct {
+		Account  string                            `bson:"account"`
+		TakenAt  time.Time                         `bson:"takenAt"`
+		Contacts []CollectionBuddySnapshotsContact `bson:"contacts"`
+		Changes  []CollectionBuddySnapshotsChange  `bson:"changes,omitempty"`
+	}
+	CollectionBuddySnapshotsContact struct {
+		AimId    string   `bson:"aimId"`
+		Name     string   `bson:"name"`
+		Groups   []string `bson:"groups"`
+		UserType string   `bson:"userType,omitempty"`
+	}
+	CollectionBuddySnapshotsChange struct {
+		AimId          string   `bson:"aimId"`
+		Change         string   `bson:"change"`
+		Name           string   `bson:"name,omitempty"`
+		PreviousName   string   `bson:"previousName,omitempty"`
+		Groups         []string `bson:"groups,omitempty"`
+		PreviousGroups []string `bson:"previousGroups,omitempty"`
+	}
+
+	CollectionJobs struct {
+		ID          string                `bson:"_id"`
+		Queue       string                `bson:"queue"`
+		Type        string                `bson:"type"`
+		Key         string                `bson:"key"`
+		Description string                `bson:"description"`
+		Payload     interface{}           `bson:"payload"`
+		Status      string                `bson:"status"`
+		Attempts    int                   `bson:"attempts"`
+		Errors      []CollectionJobsError `bson:"errors,omitempty"`
+		LeasedBy    string                `bson:"leasedBy,omitempty"`
+		VisibleAt   time.Time             `bson:"visibleAt"`
+		LeaseUntil  time.Time             `bson:"leaseUntil"`
+		CreatedAt   time.Time             `bson:"createdAt"`
+		UpdatedAt   time.Time             `bson:"updatedAt"`
+	}
+	CollectionJobsError struct {
+		Attempt int       `bson:"attempt"`
+		Error   string    `bson:"error"`
+		Time    time.Time `bson:"time"`
+	}
+
+	CollectionCheckpoints struct {
+		AimId     string    `bson:"aimId"`
+		Account   string    `bson:"account,omitempty"`
+		LastMsgId uint64    `bson:"lastMsgId"`
+		Completed bool      `bson:"completed"`
+		UpdatedAt time.Time `bson:"updatedAt"`
 	}
 
-	// TODO - RESPONSE SAVE
+	CollectionRuns struct {
+		ID              string                `bson:"_id"`
+		Status          string                `bson:"status"`
+		StartedAt       time.Time             `bson:"startedAt"`
+		FinishedAt      time.Time             `bson:"finishedAt"`
+		Params          *CollectionRunsParams `bson:"params"`
+		ChatsAttempted  int64                 `bson:"chatsAttempted"`
+		ChatsDone       int64                 `bson:"chatsDone"`
+		MessagesFetched int64                 `bson:"messagesFetched"`
+		MessagesSaved   int64                 `bson:"messagesSaved"`
+		JobsFailed      int64                 `bson:"jobsFailed"`
+		Chats           []CollectionRunsChat  `bson:"chats,omitempty"`
+		Errors          []CollectionRunsError `bson:"errors,omitempty"`
+	}
+	CollectionRunsParams struct {
+		Chats       []string `bson:"chats"`
+		Exclude     []string `bson:"exclude,omitempty"`
+		Queue       string   `bson:"queue"`
+		Workers     int      `bson:"workers"`
+		Autoscale   bool     `bson:"autoscale"`
+		Restart     bool     `bson:"restart"`
+		Attachments string   `bson:"attachments,omitempty"`
+		WriteBatch  int      `bson:"writeBatch"`
+		Accounts    []string `bson:"accounts,omitempty"`
+	}
+	CollectionRunsChat struct {
+		AimId           string `bson:"aimId"`
+		Account         string `bson:"account,omitempty"`
+		MessagesFetched int64  `bson:"messagesFetched"`
+		MessagesSaved   int64  `bson:"messagesSaved"`
+		Checkpoint      uint64 `bson:"checkpoint"`
+		Completed       bool   `bson:"completed"`
+	}
+	CollectionRunsError struct {
+		Time  time.Time `bson:"time"`
+		Job   string    `bson:"job,omitempty"`
+		Error string    `bson:"error"`
+	}
 )
 
 /* test database credentials ( yes, i know; it's public data, ok? ):
@@ -102,21 +276,21 @@ func (m *MongoDB) dbDisconnect() (e error) {
 	return e
 }
 
-func (m *MongoDB) dbInsertOne(collection string, data *interface{}) (e error) {
-	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+func (m *MongoDB) dbInsertOne(ctx context.Context, collection string, data *interface{}) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
 	defer cncl()
 
 	var res *mongo.InsertOneResult
 	if res, e = m.client.Database("icqdumper").Collection(collection).InsertOne(ctx, *data); e == nil {
-		m.log.Info().Str("inserted id", res.InsertedID.(primitive.ObjectID).Hex()).
+		m.log.Debug().Interface("inserted id", res.InsertedID).
 			Msg("New record has been successfully writed")
 	}
 
 	return e
 }
 
-func (m *MongoDB) dbInsertMany(collection string, data *[]interface{}) (e error) {
-	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+func (m *MongoDB) dbInsertMany(ctx context.Context, collection string, data *[]interface{}) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
 	defer cncl()
 
 	m.log.Debug().Msg("Hey, I'm here!")
@@ -132,12 +306,12 @@ func (m *MongoDB) dbInsertMany(collection string, data *[]interface{}) (e error)
 	return e
 }
 
-func (m *MongoDB) dbUpdateOne(collection string, filter interface{}, data interface{}) (e error) {
-	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+func (m *MongoDB) dbUpdateOne(ctx context.Context, collection string, filter interface{}, data interface{}, opts ...*options.UpdateOptions) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
 	defer cncl()
 
 	//	var res *mongo.UpdateResult
-	if _, e = m.client.Database("icqdumper").Collection(collection).UpdateOne(ctx, filter, data); e == nil {
+	if _, e = m.client.Database("icqdumper").Collection(collection).UpdateOne(ctx, filter, data, opts...); e == nil {
 		return
 		//		m.log.Info().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).
 		//			Msg("Some records in collection has been successfully updated")
@@ -146,8 +320,8 @@ func (m *MongoDB) dbUpdateOne(collection string, filter interface{}, data interf
 	return
 }
 
-func (m *MongoDB) dbUpdateMany(collection string, filter interface{}, data interface{}) (e error) {
-	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+func (m *MongoDB) dbUpdateMany(ctx context.Context, collection string, filter interface{}, data interface{}) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
 	defer cncl()
 
 	var res *mongo.UpdateResult
@@ -159,6 +333,71 @@ func (m *MongoDB) dbUpdateMany(collection string, filter interface{}, data inter
 	return
 }
 
+func (m *MongoDB) dbFind(ctx context.Context, collection string, filter interface{}, result interface{}, opts ...*options.FindOptions) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
+	defer cncl()
+
+	var cursor *mongo.Cursor
+	if cursor, e = m.client.Database("icqdumper").Collection(collection).Find(ctx, filter, opts...); e != nil {
+		return e
+	}
+
+	return cursor.All(ctx, result)
+}
+
+func (m *MongoDB) dbAggregate(ctx context.Context, collection string, pipeline interface{}, result interface{}) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
+	defer cncl()
+
+	var cursor *mongo.Cursor
+	if cursor, e = m.client.Database("icqdumper").Collection(collection).Aggregate(ctx, pipeline); e != nil {
+		return e
+	}
+
+	return cursor.All(ctx, result)
+}
+
+func (m *MongoDB) dbFindOne(ctx context.Context, collection string, filter interface{}, result interface{}, opts ...*options.FindOneOptions) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
+	defer cncl()
+
+	return m.client.Database("icqdumper").Collection(collection).FindOne(ctx, filter, opts...).Decode(result)
+}
+
+func (m *MongoDB) dbFindOneAndUpdate(ctx context.Context, collection string, filter interface{}, data interface{}, result interface{}, opts ...*options.FindOneAndUpdateOptions) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
+	defer cncl()
+
+	return m.client.Database("icqdumper").Collection(collection).FindOneAndUpdate(ctx, filter, data, opts...).Decode(result)
+}
+
+func (m *MongoDB) dbDeleteOne(ctx context.Context, collection string, filter interface{}) (e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
+	defer cncl()
+
+	_, e = m.client.Database("icqdumper").Collection(collection).DeleteOne(ctx, filter)
+	return e
+}
+
+func (m *MongoDB) dbCountDocuments(ctx context.Context, collection string, filter interface{}) (count int64, e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
+	defer cncl()
+
+	return m.client.Database("icqdumper").Collection(collection).CountDocuments(ctx, filter)
+}
+
+func (m *MongoDB) dbBulkWrite(ctx context.Context, collection string, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (res *mongo.BulkWriteResult, e error) {
+	ctx, cncl := context.WithTimeout(ctx, 10*time.Second)
+	defer cncl()
+
+	if res, e = m.client.Database("icqdumper").Collection(collection).BulkWrite(ctx, models, opts...); e == nil {
+		m.log.Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Int64("upserted", res.UpsertedCount).
+			Msg("Bulk write has been successfully applied")
+	}
+
+	return res, e
+}
+
 func (m *MongoDB) Construct() error { return m.dbConnect() }
 func (m *MongoDB) Destruct() error {
 	if m.cnclFunc != nil {
@@ -167,15 +406,36 @@ func (m *MongoDB) Destruct() error {
 
 	return m.dbDisconnect()
 }
-func (m *MongoDB) InsertOne(collection string, data *interface{}) (e error) {
-	return m.dbInsertOne(collection, data)
+func (m *MongoDB) InsertOne(ctx context.Context, collection string, data *interface{}) (e error) {
+	return m.dbInsertOne(ctx, collection, data)
+}
+func (m *MongoDB) InsertMany(ctx context.Context, collection string, data *[]interface{}) (e error) {
+	return m.dbInsertMany(ctx, collection, data)
+}
+func (m *MongoDB) UpdateOne(ctx context.Context, collection string, filter interface{}, data interface{}, opts ...*options.UpdateOptions) (e error) {
+	return m.dbUpdateOne(ctx, collection, filter, data, opts...)
+}
+func (m *MongoDB) UpdateMany(ctx context.Context, collection string, filter interface{}, data interface{}) (e error) {
+	return m.dbUpdateMany(ctx, collection, filter, data)
+}
+func (m *MongoDB) Find(ctx context.Context, collection string, filter interface{}, result interface{}, opts ...*options.FindOptions) (e error) {
+	return m.dbFind(ctx, collection, filter, result, opts...)
+}
+func (m *MongoDB) Aggregate(ctx context.Context, collection string, pipeline interface{}, result interface{}) (e error) {
+	return m.dbAggregate(ctx, collection, pipeline, result)
+}
+func (m *MongoDB) FindOne(ctx context.Context, collection string, filter interface{}, result interface{}, opts ...*options.FindOneOptions) (e error) {
+	return m.dbFindOne(ctx, collection, filter, result, opts...)
+}
+func (m *MongoDB) FindOneAndUpdate(ctx context.Context, collection string, filter interface{}, data interface{}, result interface{}, opts ...*options.FindOneAndUpdateOptions) (e error) {
+	return m.dbFindOneAndUpdate(ctx, collection, filter, data, result, opts...)
 }
-func (m *MongoDB) InsertMany(collection string, data *[]interface{}) (e error) {
-	return m.dbInsertMany(collection, data)
+func (m *MongoDB) DeleteOne(ctx context.Context, collection string, filter interface{}) (e error) {
+	return m.dbDeleteOne(ctx, collection, filter)
 }
-func (m *MongoDB) UpdateOne(collection string, filter interface{}, data interface{}) (e error) {
-	return m.dbUpdateOne(collection, filter, data)
+func (m *MongoDB) CountDocuments(ctx context.Context, collection string, filter interface{}) (count int64, e error) {
+	return m.dbCountDocuments(ctx, collection, filter)
 }
-func (m *MongoDB) UpdateMany(collection string, filter interface{}, data interface{}) (e error) {
-	return m.dbUpdateMany(collection, filter, data)
+func (m *MongoDB) BulkWrite(ctx context.Context, collection string, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (res *mongo.BulkWriteResult, e error) {
+	return m.dbBulkWrite(ctx, collection, models, opts...)
 }